@@ -4,9 +4,12 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
 
 	"github.com/gabstv/sandpiper/internal/pkg/route"
+	"github.com/gabstv/sandpiper/pkg/certmonitor"
 )
 
 // Client is the API client.
@@ -75,3 +78,133 @@ func (c *Client) GetRoutes() (map[string]route.Route, error) {
 	}
 	return jd, nil
 }
+
+// SetMaintenance changes the maintenance mode of a route
+// (or of the whole server if domain is empty).
+func (c *Client) SetMaintenance(domain string, cfg route.MaintenanceConfig) error {
+	path := "/v1/maintenance"
+	if domain != "" {
+		path += "/" + url.PathEscape(domain)
+	}
+	return c.call(http.MethodPut, path, cfg, nil)
+}
+
+// SetSplitWeights changes the upstream group weights of a SPLIT route.
+func (c *Client) SetSplitWeights(domain string, weights map[string]int) error {
+	return c.call(http.MethodPut, "/v1/split/"+url.PathEscape(domain), map[string]interface{}{"weights": weights}, nil)
+}
+
+// Certificates lists the certificates held by the server.
+func (c *Client) Certificates() ([]Certificate, error) {
+	jd := struct {
+		Certificates []Certificate `json:"certificates"`
+	}{}
+	if err := c.call(http.MethodGet, "/v1/certificates", nil, &jd); err != nil {
+		return nil, err
+	}
+	return jd.Certificates, nil
+}
+
+// CertificateAlerts returns the expiring certificates and the failed
+// renewals.
+func (c *Client) CertificateAlerts() ([]certmonitor.Alert, error) {
+	jd := struct {
+		Alerts []certmonitor.Alert `json:"alerts"`
+	}{}
+	if err := c.call(http.MethodGet, "/v1/certificates/alerts", nil, &jd); err != nil {
+		return nil, err
+	}
+	return jd.Alerts, nil
+}
+
+// DevCA returns the PEM root certificate of the dev mode.
+func (c *Client) DevCA() ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, c.Endpoint+"/v1/certificates/dev-ca", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-API-KEY", c.APIKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Header.Get("Content-Type") != "application/x-pem-file" {
+		jd := struct {
+			Error string `json:"error,omitempty"`
+		}{}
+		if err := json.Unmarshal(data, &jd); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf(jd.Error)
+	}
+	return data, nil
+}
+
+// RenewCertificate obtains a new ACME certificate for domain.
+func (c *Client) RenewCertificate(domain string) error {
+	return c.call(http.MethodPost, "/v1/certificates/"+url.PathEscape(domain)+"/renew", nil, nil)
+}
+
+// RevokeCertificate revokes and removes the ACME certificate of domain.
+func (c *Client) RevokeCertificate(domain string) error {
+	return c.call(http.MethodPost, "/v1/certificates/"+url.PathEscape(domain)+"/revoke", nil, nil)
+}
+
+// PutCertificate uploads a PEM certificate pair for domain.
+func (c *Client) PutCertificate(domain string, certPEM, keyPEM []byte) error {
+	pair := CertificatePair{
+		Cert: string(certPEM),
+		Key:  string(keyPEM),
+	}
+	return c.call(http.MethodPut, "/v1/certificates/"+url.PathEscape(domain), pair, nil)
+}
+
+// DeleteCertificate removes the uploaded and the cached autocert
+// certificates of domain.
+func (c *Client) DeleteCertificate(domain string) error {
+	return c.call(http.MethodDelete, "/v1/certificates/"+url.PathEscape(domain), nil, nil)
+}
+
+// call sends body (if not nil) as json and decodes the response into out
+// (if not nil), returning the api error of unsuccessful responses.
+func (c *Client) call(method, path string, body, out interface{}) error {
+	buf := new(bytes.Buffer)
+	if body != nil {
+		if err := json.NewEncoder(buf).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, c.Endpoint+path, buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-API-KEY", c.APIKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	jd := struct {
+		Success bool   `json:"success"`
+		Error   string `json:"error,omitempty"`
+	}{}
+	if err := json.Unmarshal(data, &jd); err != nil {
+		return err
+	}
+	if !jd.Success {
+		return fmt.Errorf(jd.Error)
+	}
+	if out != nil {
+		return json.Unmarshal(data, out)
+	}
+	return nil
+}
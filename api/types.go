@@ -1,8 +1,36 @@
 package api
 
+import (
+	"time"
+
+	"github.com/gabstv/sandpiper/internal/pkg/route"
+)
+
 type NewRoute struct {
 	Domain   string `json:"domain,omitempty"`
 	Autocert bool   `json:"autocert,omitempty"`
 	OutType  string `json:"out_type,omitempty"`
 	OutPath  string `json:"out_path,omitempty"`
+	// Rules are the ordered match rules of the route
+	Rules []route.MatchRule `json:"rules,omitempty"`
+}
+
+// Certificate describes a certificate held by the server.
+type Certificate struct {
+	// ID is the certificate store id (or the autocert cache key)
+	ID string `json:"id"`
+	// Source is file, autocert, acme-dns, dev or upload
+	Source    string    `json:"source"`
+	DNSNames  []string  `json:"dns_names"`
+	Issuer    string    `json:"issuer"`
+	Serial    string    `json:"serial"`
+	KeyType   string    `json:"key_type"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+}
+
+// CertificatePair is a PEM encoded certificate chain and private key.
+type CertificatePair struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
 }
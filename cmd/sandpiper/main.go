@@ -9,10 +9,19 @@ import (
 	"os/signal"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gabstv/sandpiper/internal/pkg/envs"
 	"github.com/gabstv/sandpiper/internal/pkg/route"
+	"github.com/gabstv/sandpiper/pkg/accesslog"
+	"github.com/gabstv/sandpiper/pkg/acmedns"
+	"github.com/gabstv/sandpiper/pkg/certmonitor"
+	"github.com/gabstv/sandpiper/pkg/errorpage"
+	"github.com/gabstv/sandpiper/pkg/logging"
+	"github.com/gabstv/sandpiper/pkg/ratelimit"
 	"github.com/gabstv/sandpiper/pkg/server"
+	"github.com/gabstv/sandpiper/pkg/tlspolicy"
+	"github.com/gabstv/sandpiper/pkg/tracing"
 	"github.com/gabstv/sandpiper/pkg/util"
 	colorable "github.com/mattn/go-colorable"
 	"github.com/mgutz/ansi"
@@ -56,9 +65,6 @@ func main() {
 	// unpack Config
 	svCfg := &server.Config{}
 	svCfg.Debug = cfg.Debug
-	if svCfg.Debug {
-		util.DEBUG = true
-	}
 	svCfg.ListenAddr = cfg.ListenAddr
 	svCfg.ListenAddrTLS = cfg.ListenAddrTLS
 	svCfg.DisableTLS = cfg.DisableTLS
@@ -80,6 +86,47 @@ func main() {
 	svCfg.S3Bucket = cfg.S3Bucket
 	svCfg.S3Folder = cfg.S3Folder
 	svCfg.AutocertAll = cfg.AutocertAll
+	svCfg.Allow = cfg.Allow
+	svCfg.Deny = cfg.Deny
+	svCfg.DenyStatus = cfg.DenyStatus
+	svCfg.TrustedProxies = cfg.TrustedProxies
+	svCfg.ProxyProtocol = cfg.ProxyProtocol
+	svCfg.APIAllow = cfg.APIAllow
+	svCfg.MetricsAllow = cfg.MetricsAllow
+	svCfg.ReadHeaderTimeout = time.Duration(cfg.ReadHeaderTimeout) * time.Second
+	svCfg.ReadTimeout = time.Duration(cfg.ReadTimeout) * time.Second
+	svCfg.WriteTimeout = time.Duration(cfg.WriteTimeout) * time.Second
+	svCfg.IdleTimeout = time.Duration(cfg.IdleTimeout) * time.Second
+	svCfg.MaxHeaderBytes = cfg.MaxHeaderBytes
+	svCfg.MaxBodyBytes = cfg.MaxBodyBytes
+	svCfg.Upstream = cfg.Upstream
+	svCfg.AccessLog = cfg.AccessLog
+	svCfg.ErrorPages = cfg.ErrorPages
+	svCfg.Maintenance = cfg.Maintenance
+	svCfg.CertReloadInterval = time.Duration(cfg.CertReloadInterval) * time.Second
+	svCfg.ACMEDNS = cfg.ACMEDNS
+	svCfg.CertMonitor = cfg.CertMonitor
+	svCfg.DisableOCSPStapling = cfg.DisableOCSPStapling
+	svCfg.TLS = cfg.TLS
+	svCfg.DisableHTTP2 = cfg.DisableHTTP2
+	svCfg.H2C = cfg.H2C
+	svCfg.HTTP3 = cfg.HTTP3
+	for _, v := range cfg.Certificates {
+		svCfg.Certificates = append(svCfg.Certificates, util.Certificate{
+			CertFile: v.CertFile,
+			KeyFile:  v.KeyFile,
+		})
+	}
+	if cfg.DefaultCertificate != nil {
+		svCfg.DefaultCertificate = &util.Certificate{
+			CertFile: cfg.DefaultCertificate.CertFile,
+			KeyFile:  cfg.DefaultCertificate.KeyFile,
+		}
+	}
+	svCfg.Tracing = cfg.Tracing
+	svCfg.RequestIDHeader = cfg.RequestIDHeader
+	svCfg.TrustRequestID = cfg.TrustRequestID
+	svCfg.Log = cfg.Log
 
 	// ENV VARS
 	if dbg, ok := envs.Debug(); ok {
@@ -143,6 +190,113 @@ func main() {
 	if vv := os.Getenv("FALLBACK_DOMAIN"); vv != "" {
 		svCfg.FallbackDomain = vv
 	}
+	if vv := os.Getenv("ALLOW"); vv != "" {
+		svCfg.Allow = strings.Split(vv, ",")
+	}
+	if vv := os.Getenv("DENY"); vv != "" {
+		svCfg.Deny = strings.Split(vv, ",")
+	}
+	if vv := os.Getenv("DENY_STATUS"); vv != "" {
+		svCfg.DenyStatus, _ = strconv.Atoi(vv)
+	}
+	if vv := os.Getenv("TRUSTED_PROXIES"); vv != "" {
+		svCfg.TrustedProxies = strings.Split(vv, ",")
+	}
+	if vv := os.Getenv("PROXY_PROTOCOL"); vv != "" {
+		svCfg.ProxyProtocol = (vv == "1")
+	}
+	if vv := os.Getenv("API_ALLOW"); vv != "" {
+		svCfg.APIAllow = strings.Split(vv, ",")
+	}
+	if vv := os.Getenv("METRICS_ALLOW"); vv != "" {
+		svCfg.MetricsAllow = strings.Split(vv, ",")
+	}
+	if vv := os.Getenv("READ_HEADER_TIMEOUT"); vv != "" {
+		n, _ := strconv.Atoi(vv)
+		svCfg.ReadHeaderTimeout = time.Duration(n) * time.Second
+	}
+	if vv := os.Getenv("READ_TIMEOUT"); vv != "" {
+		n, _ := strconv.Atoi(vv)
+		svCfg.ReadTimeout = time.Duration(n) * time.Second
+	}
+	if vv := os.Getenv("WRITE_TIMEOUT"); vv != "" {
+		n, _ := strconv.Atoi(vv)
+		svCfg.WriteTimeout = time.Duration(n) * time.Second
+	}
+	if vv := os.Getenv("IDLE_TIMEOUT"); vv != "" {
+		n, _ := strconv.Atoi(vv)
+		svCfg.IdleTimeout = time.Duration(n) * time.Second
+	}
+	if vv := os.Getenv("MAX_HEADER_BYTES"); vv != "" {
+		svCfg.MaxHeaderBytes, _ = strconv.Atoi(vv)
+	}
+	if vv := os.Getenv("MAX_BODY_BYTES"); vv != "" {
+		svCfg.MaxBodyBytes, _ = strconv.ParseInt(vv, 10, 64)
+	}
+	if vv := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); vv != "" {
+		if svCfg.Tracing == nil {
+			svCfg.Tracing = &tracing.Config{}
+		}
+		svCfg.Tracing.Endpoint = vv
+	}
+	if vv := os.Getenv("LOG_LEVEL"); vv != "" {
+		if svCfg.Log == nil {
+			svCfg.Log = &logging.Config{}
+		}
+		svCfg.Log.Level = vv
+	}
+	if vv := os.Getenv("LOG_FORMAT"); vv != "" {
+		if svCfg.Log == nil {
+			svCfg.Log = &logging.Config{}
+		}
+		svCfg.Log.Format = vv
+	}
+	if vv := os.Getenv("CERT_RELOAD_INTERVAL"); vv != "" {
+		n, _ := strconv.Atoi(vv)
+		svCfg.CertReloadInterval = time.Duration(n) * time.Second
+	}
+	if vv := os.Getenv("TLS_PRESET"); vv != "" {
+		if svCfg.TLS == nil {
+			svCfg.TLS = &tlspolicy.Config{}
+		}
+		svCfg.TLS.Preset = vv
+	}
+	if vv := os.Getenv("TLS_MIN_VERSION"); vv != "" {
+		if svCfg.TLS == nil {
+			svCfg.TLS = &tlspolicy.Config{}
+		}
+		svCfg.TLS.MinVersion = vv
+	}
+	if vv := os.Getenv("DISABLE_OCSP_STAPLING"); vv != "" {
+		svCfg.DisableOCSPStapling = (vv == "1")
+	}
+	if vv := os.Getenv("DISABLE_HTTP2"); vv != "" {
+		svCfg.DisableHTTP2 = (vv == "1")
+	}
+	if vv := os.Getenv("H2C"); vv != "" {
+		svCfg.H2C = (vv == "1")
+	}
+	if vv := os.Getenv("HTTP3"); vv != "" {
+		svCfg.HTTP3 = (vv == "1")
+	}
+	if vv := os.Getenv("CERT_MONITOR_WEBHOOK"); vv != "" {
+		if svCfg.CertMonitor == nil {
+			svCfg.CertMonitor = &certmonitor.Config{}
+		}
+		svCfg.CertMonitor.Webhook = vv
+	}
+	if vv := os.Getenv("MAINTENANCE"); vv != "" {
+		if svCfg.Maintenance == nil {
+			svCfg.Maintenance = &route.MaintenanceConfig{}
+		}
+		svCfg.Maintenance.Enabled = (vv == "1")
+	}
+	if vv := os.Getenv("REQUEST_ID_HEADER"); vv != "" {
+		svCfg.RequestIDHeader = vv
+	}
+	if vv := os.Getenv("TRUST_REQUEST_ID"); vv != "" {
+		svCfg.TrustRequestID = (vv == "1")
+	}
 
 	s := server.Default(svCfg)
 
@@ -163,12 +317,31 @@ func main() {
 		r.Certificate.CertFile = v.TLSCertFile
 		r.Certificate.KeyFile = v.TLSKeyFile
 		r.Autocert = v.Autocert
+		r.AutocertDNS = v.AutocertDNS
+		r.DisableHTTP2 = v.DisableHTTP2
 		r.AuthMode = v.AuthMode
 		r.AuthKey = v.AuthKey
 		r.AuthValue = v.AuthValue
 		r.ForceHTTPS = v.ForceHTTPS
 		r.Server.LoadBalancer = v.LoadBalancer
+		r.Server.Split = v.Split
 		r.FlushInterval = v.FlushInterval
+		r.Allow = v.Allow
+		r.Deny = v.Deny
+		r.DenyStatus = v.DenyStatus
+		r.RateLimit = v.RateLimit
+		r.Server.MaxConcurrent = v.MaxConcurrent
+		r.MaxBodyBytes = v.MaxBodyBytes
+		r.MaxHeaderBytes = v.MaxHeaderBytes
+		r.ReadTimeout = v.ReadTimeout
+		r.WriteTimeout = v.WriteTimeout
+		r.Transport = v.Transport
+		r.UpstreamTLS = v.UpstreamTLS
+		r.AccessLog = v.AccessLog
+		r.ErrorPages = v.ErrorPages
+		r.Maintenance = v.Maintenance
+		r.Mirror = v.Mirror
+		r.Rules = v.Rules
 		if v.Domain == "" && v.Domains != nil && len(v.Domains) > 0 {
 			for _, dname := range v.Domains {
 				r2 := r
@@ -223,6 +396,12 @@ func main() {
 			if v := os.Getenv(fmt.Sprintf("R%d_AUTOCERT", i)); v == "1" || v == "true" || v == "TRUE" {
 				r.Autocert = true
 			}
+			if v := os.Getenv(fmt.Sprintf("R%d_AUTOCERT_DNS", i)); v == "1" || v == "true" || v == "TRUE" {
+				r.AutocertDNS = true
+			}
+			if v := os.Getenv(fmt.Sprintf("R%d_DISABLE_HTTP2", i)); v == "1" || v == "true" || v == "TRUE" {
+				r.DisableHTTP2 = true
+			}
 			if v := os.Getenv(fmt.Sprintf("R%d_AUTH_MODE", i)); v != "" {
 				r.AuthMode = v
 			}
@@ -238,6 +417,37 @@ func main() {
 			if v := os.Getenv(fmt.Sprintf("R%d_FLUSH_INTERVAL", i)); v != "" {
 				r.FlushInterval, _ = strconv.Atoi(v)
 			}
+			if v := os.Getenv(fmt.Sprintf("R%d_ALLOW", i)); v != "" {
+				r.Allow = strings.Split(v, ",")
+			}
+			if v := os.Getenv(fmt.Sprintf("R%d_DENY", i)); v != "" {
+				r.Deny = strings.Split(v, ",")
+			}
+			if v := os.Getenv(fmt.Sprintf("R%d_DENY_STATUS", i)); v != "" {
+				r.DenyStatus, _ = strconv.Atoi(v)
+			}
+			if v := os.Getenv(fmt.Sprintf("R%d_RATE_LIMIT", i)); v != "" {
+				rl := &ratelimit.Config{}
+				rl.Rate, _ = strconv.ParseFloat(v, 64)
+				rl.Burst, _ = strconv.Atoi(os.Getenv(fmt.Sprintf("R%d_RATE_LIMIT_BURST", i)))
+				rl.Key = os.Getenv(fmt.Sprintf("R%d_RATE_LIMIT_KEY", i))
+				r.RateLimit = rl
+			}
+			if v := os.Getenv(fmt.Sprintf("R%d_MAX_CONCURRENT", i)); v != "" {
+				r.Server.MaxConcurrent, _ = strconv.Atoi(v)
+			}
+			if v := os.Getenv(fmt.Sprintf("R%d_MAX_BODY_BYTES", i)); v != "" {
+				r.MaxBodyBytes, _ = strconv.ParseInt(v, 10, 64)
+			}
+			if v := os.Getenv(fmt.Sprintf("R%d_MAX_HEADER_BYTES", i)); v != "" {
+				r.MaxHeaderBytes, _ = strconv.Atoi(v)
+			}
+			if v := os.Getenv(fmt.Sprintf("R%d_READ_TIMEOUT", i)); v != "" {
+				r.ReadTimeout, _ = strconv.Atoi(v)
+			}
+			if v := os.Getenv(fmt.Sprintf("R%d_WRITE_TIMEOUT", i)); v != "" {
+				r.WriteTimeout, _ = strconv.Atoi(v)
+			}
 			r.WsCFG.Enabled = true
 			r.WsCFG.ReadBufferSize = 1024 * 8
 			r.WsCFG.WriteBufferSize = 1024 * 8
@@ -334,6 +544,9 @@ func unpackConnType(input string) (route.ConnType, bool) {
 	if input == "LOAD_BALANCER" {
 		return route.LOAD_BALANCER, true
 	}
+	if input == "SPLIT" {
+		return route.SPLIT, true
+	}
 	return route.HTTP, false
 }
 
@@ -361,6 +574,51 @@ type Config struct {
 	S3Bucket          string        `yaml:"s3_bucket"`
 	S3Folder          string        `yaml:"s3_folder"`
 	AutocertAll       bool          `yaml:"autocert_all"`
+	Allow             []string      `yaml:"allow"`
+	Deny              []string      `yaml:"deny"`
+	DenyStatus        int           `yaml:"deny_status"`
+	TrustedProxies    []string      `yaml:"trusted_proxies"`
+	ProxyProtocol     bool          `yaml:"proxy_protocol"`
+	APIAllow          []string      `yaml:"api_allow"`
+	// timeouts in seconds
+	ReadHeaderTimeout int                      `yaml:"read_header_timeout"`
+	ReadTimeout       int                      `yaml:"read_timeout"`
+	WriteTimeout      int                      `yaml:"write_timeout"`
+	IdleTimeout       int                      `yaml:"idle_timeout"`
+	MaxHeaderBytes    int                      `yaml:"max_header_bytes"`
+	MaxBodyBytes      int64                    `yaml:"max_body_bytes"`
+	Upstream          route.TransportConfig    `yaml:"upstream"`
+	AccessLog         *accesslog.Config        `yaml:"access_log"`
+	ErrorPages        *errorpage.Config        `yaml:"error_pages"`
+	Maintenance       *route.MaintenanceConfig `yaml:"maintenance"`
+	// seconds (negative = disabled)
+	CertReloadInterval int                 `yaml:"cert_reload_interval"`
+	Certificates       []ConfigCertificate `yaml:"certificates"`
+	DefaultCertificate *ConfigCertificate  `yaml:"default_certificate"`
+	ACMEDNS            *acmedns.Config     `yaml:"acme_dns"`
+	CertMonitor        *certmonitor.Config `yaml:"cert_monitor"`
+	Tracing            *tracing.Config     `yaml:"tracing"`
+	RequestIDHeader    string              `yaml:"request_id_header"`
+	TrustRequestID     bool                `yaml:"trust_request_id"`
+	Log                *logging.Config     `yaml:"log"`
+	// OCSP stapling of the certificate files is enabled by default
+	DisableOCSPStapling bool `yaml:"disable_ocsp_stapling"`
+	// TLS policy of the TLS listener
+	TLS *tlspolicy.Config `yaml:"tls"`
+	// HTTP/2 is negotiated on the TLS listener unless disabled
+	DisableHTTP2 bool `yaml:"disable_http2"`
+	// H2C serves cleartext HTTP/2 on the HTTP listener
+	H2C bool `yaml:"h2c"`
+	// HTTP3 serves HTTP/3 on the UDP port of the TLS listener
+	HTTP3 bool `yaml:"http3"`
+	// MetricsAllow can read /metrics without the API key (default: loopback)
+	MetricsAllow []string `yaml:"metrics_allow"`
+}
+
+// ConfigCertificate is a certificate/key file pair
+type ConfigCertificate struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
 }
 
 // ConfigRoute represents a domain route
@@ -372,11 +630,30 @@ type ConfigRoute struct {
 	TLSCertFile            string                    `yaml:"tls_cert_file"`
 	TLSKeyFile             string                    `yaml:"tls_key_file"`
 	Autocert               bool                      `yaml:"autocert"`
+	AutocertDNS            bool                      `yaml:"autocert_dns"`
 	Websockets             util.WsConfig             `yaml:"websockets"`
 	AuthMode               string                    `yaml:"auth_mode"`
 	AuthKey                string                    `yaml:"auth_key"`
 	AuthValue              string                    `yaml:"auth_value"`
 	ForceHTTPS             bool                      `yaml:"force_https"`
 	LoadBalancer           *route.LoadBalancerConfig `yaml:"load_balancer"`
+	Split                  *route.SplitConfig        `yaml:"split"`
 	FlushInterval          int                       `yaml:"flush_interval"`
+	Allow                  []string                  `yaml:"allow"`
+	Deny                   []string                  `yaml:"deny"`
+	DenyStatus             int                       `yaml:"deny_status"`
+	RateLimit              *ratelimit.Config         `yaml:"rate_limit"`
+	MaxConcurrent          int                       `yaml:"max_concurrent"`
+	MaxBodyBytes           int64                     `yaml:"max_body_bytes"`
+	MaxHeaderBytes         int                       `yaml:"max_header_bytes"`
+	ReadTimeout            int                       `yaml:"read_timeout"`
+	WriteTimeout           int                       `yaml:"write_timeout"`
+	Transport              *route.TransportConfig    `yaml:"transport"`
+	UpstreamTLS            *route.UpstreamTLSConfig  `yaml:"upstream_tls"`
+	AccessLog              *bool                     `yaml:"access_log"`
+	ErrorPages             *errorpage.Config         `yaml:"error_pages"`
+	Maintenance            *route.MaintenanceConfig  `yaml:"maintenance"`
+	Mirror                 *route.MirrorConfig       `yaml:"mirror"`
+	Rules                  []route.MatchRule         `yaml:"rules"`
+	DisableHTTP2           bool                      `yaml:"disable_http2"`
 }
@@ -1,20 +1,48 @@
 module github.com/gabstv/sandpiper
 
-go 1.12
+go 1.21
 
 require (
-	github.com/armon/go-proxyproto v0.0.0-20190211145416-68259f75880e // indirect
+	github.com/armon/go-proxyproto v0.0.0-20190211145416-68259f75880e
 	github.com/aws/aws-sdk-go v1.19.12
 	github.com/gabstv/freeport v0.0.0-20171005142102-7952fe2e67ce
 	github.com/gabstv/manners v0.0.0-20180125124109-595c9a4a88f0
 	github.com/gin-gonic/gin v1.7.0
 	github.com/gorilla/websocket v1.4.3-0.20210424162022-e8629af678b7
-	github.com/mailgun/manners v0.0.0-20170509042424-df18ed182a60 // indirect
 	github.com/mattn/go-colorable v0.1.1
 	github.com/mgutz/ansi v0.0.0-20170206155736-9520e82c474b
-	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
-	github.com/modern-go/reflect2 v1.0.1 // indirect
+	github.com/miekg/dns v1.1.50
 	github.com/pkg/errors v0.8.1
-	golang.org/x/crypto v0.3.0
+	github.com/quic-go/quic-go v0.42.0
+	golang.org/x/crypto v0.4.0
+	golang.org/x/net v0.10.0
 	gopkg.in/yaml.v2 v2.2.8
 )
+
+require (
+	github.com/gin-contrib/sse v0.1.0 // indirect
+	github.com/go-playground/locales v0.13.0 // indirect
+	github.com/go-playground/universal-translator v0.17.0 // indirect
+	github.com/go-playground/validator/v10 v10.4.1 // indirect
+	github.com/go-task/slim-sprig v0.0.0-20230315185526-52ccab3ef572 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/google/pprof v0.0.0-20210407192527-94a9f03dee38 // indirect
+	github.com/jmespath/go-jmespath v0.0.0-20180206201540-c2b33e8439af // indirect
+	github.com/json-iterator/go v1.1.9 // indirect
+	github.com/kr/pretty v0.3.1 // indirect
+	github.com/leodido/go-urn v1.2.0 // indirect
+	github.com/mailgun/manners v0.0.0-20170509042424-df18ed182a60 // indirect
+	github.com/mattn/go-isatty v0.0.12 // indirect
+	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
+	github.com/modern-go/reflect2 v1.0.1 // indirect
+	github.com/onsi/ginkgo/v2 v2.9.5 // indirect
+	github.com/quic-go/qpack v0.4.0 // indirect
+	github.com/ugorji/go/codec v1.1.7 // indirect
+	go.uber.org/mock v0.4.0 // indirect
+	golang.org/x/exp v0.0.0-20221205204356-47842c84f3db // indirect
+	golang.org/x/mod v0.11.0 // indirect
+	golang.org/x/sys v0.8.0 // indirect
+	golang.org/x/text v0.9.0 // indirect
+	golang.org/x/tools v0.9.1 // indirect
+	google.golang.org/protobuf v1.28.0 // indirect
+)
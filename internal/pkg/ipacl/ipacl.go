@@ -0,0 +1,119 @@
+package ipacl
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ACL is a list of allowed and denied networks.
+// A nil ACL allows everything.
+type ACL struct {
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+}
+
+// New parses the allow and deny lists (CIDRs or single IPs).
+// It returns nil if both lists are empty.
+func New(allow, deny []string) (*ACL, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	a := &ACL{}
+	var err error
+	if a.Allow, err = ParseNets(allow); err != nil {
+		return nil, err
+	}
+	if a.Deny, err = ParseNets(deny); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Allowed reports whether ip may pass. Deny entries are evaluated first.
+// If the allow list is not empty, ip must be in it.
+func (a *ACL) Allowed(ip net.IP) bool {
+	if a == nil {
+		return true
+	}
+	if ip == nil {
+		return len(a.Allow) == 0 && len(a.Deny) == 0
+	}
+	if Contains(a.Deny, ip) {
+		return false
+	}
+	if len(a.Allow) > 0 {
+		return Contains(a.Allow, ip)
+	}
+	return true
+}
+
+// ParseNets parses a list of CIDRs. Single IPs are treated as /32 (or /128).
+func ParseNets(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, v := range list {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip %q", v)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				nets = append(nets, &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)})
+			} else {
+				nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)})
+			}
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// Contains reports whether ip is inside any of the networks.
+func Contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client that made the request.
+// X-Forwarded-For is only used when the connection comes from a trusted
+// proxy; the list is walked from right to left and the first untrusted
+// address is returned.
+func ClientIP(r *http.Request, trusted []*net.IPNet) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !Contains(trusted, ip) {
+		return ip
+	}
+	hops := make([]string, 0)
+	for _, v := range r.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hip == nil {
+			break
+		}
+		ip = hip
+		if !Contains(trusted, hip) {
+			break
+		}
+	}
+	return ip
+}
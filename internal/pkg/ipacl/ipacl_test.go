@@ -0,0 +1,47 @@
+package ipacl
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestAllowed(t *testing.T) {
+	acl, err := New([]string{"10.0.0.0/8", "192.168.1.10"}, []string{"10.1.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]bool{
+		"10.2.3.4":     true,
+		"10.1.3.4":     false,
+		"192.168.1.10": true,
+		"192.168.1.11": false,
+		"8.8.8.8":      false,
+	}
+	for ip, want := range cases {
+		if got := acl.Allowed(net.ParseIP(ip)); got != want {
+			t.Fatalf("Allowed(%v) should be %v but it is %v", ip, want, got)
+		}
+	}
+	var nilacl *ACL
+	if !nilacl.Allowed(net.ParseIP("8.8.8.8")) {
+		t.Fatal("nil ACL should allow everything")
+	}
+	if _, err := New([]string{"not-an-ip"}, nil); err == nil {
+		t.Fatal("invalid entry should return an error")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, _ := ParseNets([]string{"127.0.0.1", "10.0.0.0/8"})
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "127.0.0.1:5555"
+	r.Header.Set("X-Forwarded-For", "1.2.3.4, 5.6.7.8, 10.0.0.2")
+	if ip := ClientIP(r, trusted); ip.String() != "5.6.7.8" {
+		t.Fatalf("ClientIP should be 5.6.7.8 but it is %v", ip)
+	}
+	r.RemoteAddr = "9.9.9.9:5555"
+	if ip := ClientIP(r, trusted); ip.String() != "9.9.9.9" {
+		t.Fatalf("untrusted hop: ClientIP should be 9.9.9.9 but it is %v", ip)
+	}
+}
@@ -4,8 +4,10 @@ import (
 	"net/http"
 	"net/url"
 	"sync"
+	"time"
 
 	"github.com/gabstv/sandpiper/pkg/util"
+	"github.com/pkg/errors"
 )
 
 type LoadBalancerConfig struct {
@@ -28,6 +30,7 @@ type loadBalancer struct {
 	//HealthCheck *HealthCheckConfig // TODO
 	Targets         []*loadBalancerTarget
 	LastTargetIndex int // TEMP
+	route           *Route
 }
 
 type loadBalancerTarget struct {
@@ -35,6 +38,8 @@ type loadBalancerTarget struct {
 	Path        string
 	HealthScore int
 	Proxy       *util.ReverseProxy
+	// retryAt is when a target below healthThreshold gets a probe request
+	retryAt time.Time
 }
 
 func (rs *loadBalancerTarget) URL() *url.URL {
@@ -48,16 +53,117 @@ func (rs *loadBalancerTarget) URL() *url.URL {
 	return &uri
 }
 
-// ServeHTTP very simple atm
+// health score changes of the load balancer targets after each round trip.
+// Targets below healthThreshold are skipped, except for one probe request
+// every healthRetry; a successful probe puts them back at the threshold.
+const (
+	healthPenalty   = 20
+	healthRecovery  = 5
+	healthThreshold = 50
+	healthRetry     = time.Second * 10
+)
+
+// SetupLoadBalancer builds the targets of a LOAD_BALANCER route
+func (rt *Route) SetupLoadBalancer() error {
+	rt.lb = nil
+	if rt.Server.OutConnType != LOAD_BALANCER {
+		return nil
+	}
+	if rt.Server.LoadBalancer == nil {
+		return errors.New("load balancer configuration is nil")
+	}
+	lblb := &loadBalancer{route: rt}
+	lblb.Targets = make([]*loadBalancerTarget, 0)
+	transport := buildTransport(rt)
+	for _, v := range rt.Server.LoadBalancer.Targets {
+		lbt := &loadBalancerTarget{
+			Path:        v.Path,
+			HealthScore: 100,
+			Count:       0,
+		}
+		rp := util.NewSingleHostReverseProxy(lbt.URL(), defaultWebsocks, time.Second)
+		rp.Transport = transport
+		rp.DialTimeout = rt.transport.dialTimeout()
+		rp.Logger = rt.logger
+		rp.ErrorHandler = rt.upstreamError
+		rt.limitConns(rp)
+		lbt.Proxy = rp
+		lblb.Targets = append(lblb.Targets, lbt)
+	}
+	rt.lb = lblb
+	return nil
+}
+
+// ServeHTTP picks the targets in turn, skipping the unhealthy ones
 func (lb *loadBalancer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	var proxy *util.ReverseProxy
+	var target *loadBalancerTarget
 	lb.Lock()
-	index := lb.LastTargetIndex
-	lb.LastTargetIndex++
-	if len(lb.Targets) <= lb.LastTargetIndex {
-		lb.LastTargetIndex = 0
+	n := len(lb.Targets)
+	if n == 0 {
+		lb.Unlock()
+		lb.route.WriteError(rw, req, http.StatusServiceUnavailable, "no load balancer targets")
+		return
+	}
+	now := time.Now()
+	// if all the targets are unhealthy, the round robin is kept
+	index := lb.LastTargetIndex % n
+	for i := 0; i < n; i++ {
+		v := lb.Targets[(lb.LastTargetIndex+i)%n]
+		if v.HealthScore >= healthThreshold || !now.Before(v.retryAt) {
+			index = (lb.LastTargetIndex + i) % n
+			break
+		}
 	}
-	proxy = lb.Targets[index].Proxy
+	lb.LastTargetIndex = (index + 1) % n
+	target = lb.Targets[index]
+	if target.HealthScore < healthThreshold {
+		// one probe per healthRetry
+		target.retryAt = now.Add(healthRetry)
+	}
+	target.Count++
 	lb.Unlock()
-	proxy.ServeHTTP(rw, req)
+	target.Proxy.ServeHTTP(rw, req)
+	if info := util.GetRequestInfo(req.Context()); info != nil {
+		lb.observe(target, info.UpstreamError)
+	}
+}
+
+// observe updates the (passive) health score of target with the result
+// of a round trip: failures cost healthPenalty and successes recover
+// healthRecovery, between 0 and 100
+func (lb *loadBalancer) observe(target *loadBalancerTarget, err error) {
+	lb.Lock()
+	defer lb.Unlock()
+	if err != nil {
+		target.HealthScore -= healthPenalty
+		if target.HealthScore < 0 {
+			target.HealthScore = 0
+		}
+		if target.HealthScore < healthThreshold {
+			target.retryAt = time.Now().Add(healthRetry)
+		}
+		return
+	}
+	if target.HealthScore < healthThreshold {
+		target.HealthScore = healthThreshold
+		return
+	}
+	target.HealthScore += healthRecovery
+	if target.HealthScore > 100 {
+		target.HealthScore = 100
+	}
+}
+
+// TargetHealth returns the health score of each load balancer target.
+func (rt *Route) TargetHealth() map[string]int {
+	health := make(map[string]int)
+	if rt.lb == nil {
+		return health
+	}
+	rt.lb.Lock()
+	defer rt.lb.Unlock()
+	for _, v := range rt.lb.Targets {
+		health[v.Path] = v.HealthScore
+	}
+	return health
 }
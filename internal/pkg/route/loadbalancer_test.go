@@ -0,0 +1,107 @@
+package route
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gabstv/sandpiper/pkg/util"
+)
+
+func TestLoadBalancerSkipsUnhealthy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	healthy := strings.TrimPrefix(upstream.URL, "http://")
+	rt := &Route{
+		Domain: "lb.example.com",
+		Server: RouteServer{
+			OutConnType: LOAD_BALANCER,
+			LoadBalancer: &LoadBalancerConfig{Targets: []LoadBalancerTargetCfg{
+				{Path: healthy},
+				{Path: "127.0.0.1:1"},
+			}},
+		},
+	}
+	if err := rt.SetupLoadBalancer(); err != nil {
+		t.Fatal(err)
+	}
+	failed := 0
+	do := func() {
+		r := httptest.NewRequest("GET", "/", nil)
+		r, _ = util.WithRequestInfo(r)
+		w := httptest.NewRecorder()
+		rt.ReverseProxy(w, r)
+		if w.Code != http.StatusOK {
+			failed++
+		}
+	}
+	for i := 0; i < 20; i++ {
+		do()
+	}
+	// 100 -> 80 -> 60 -> 40: skipped after the third failure
+	if failed != 3 {
+		t.Fatalf("the failing target should be skipped after 3 errors, got %v errors", failed)
+	}
+	dead := rt.lb.Targets[1]
+	rt.lb.Lock()
+	dead.retryAt = time.Now().Add(-time.Second)
+	rt.lb.Unlock()
+	do()
+	do()
+	if failed != 4 {
+		t.Fatalf("the failing target should get one probe when due, got %v errors", failed)
+	}
+	if h := rt.TargetHealth()["127.0.0.1:1"]; h != 20 {
+		t.Fatalf("the failed probe should lower the score to 20, got %v", h)
+	}
+}
+
+func TestLoadBalancerMaxConcurrent(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fast.Close()
+	rt := &Route{
+		Domain: "lb.example.com",
+		Server: RouteServer{
+			OutConnType:   LOAD_BALANCER,
+			MaxConcurrent: 1,
+			LoadBalancer: &LoadBalancerConfig{Targets: []LoadBalancerTargetCfg{
+				{Path: strings.TrimPrefix(slow.URL, "http://")},
+				{Path: strings.TrimPrefix(fast.URL, "http://")},
+			}},
+		},
+	}
+	if err := rt.SetupLoadBalancer(); err != nil {
+		t.Fatal(err)
+	}
+	do := func() int {
+		w := httptest.NewRecorder()
+		rt.ReverseProxy(w, httptest.NewRequest("GET", "/", nil))
+		return w.Code
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		do()
+	}()
+	<-started
+	// the limit is per target: the slow one does not block the other
+	if code := do(); code != http.StatusOK {
+		t.Fatalf("the free target should serve the request, got %v", code)
+	}
+	if code := do(); code != http.StatusServiceUnavailable {
+		t.Fatalf("the busy target should return 503, got %v", code)
+	}
+	close(release)
+	<-done
+}
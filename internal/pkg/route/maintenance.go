@@ -0,0 +1,119 @@
+package route
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/gabstv/sandpiper/internal/pkg/ipacl"
+	"github.com/gabstv/sandpiper/pkg/errorpage"
+	"github.com/pkg/errors"
+)
+
+// MaintenanceConfig configures the maintenance mode of a route (or of the
+// whole server).
+type MaintenanceConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Page is the path of the html file served while in maintenance
+	// (default: the 503 error page)
+	Page string `json:"page,omitempty" yaml:"page"`
+	// Message is shown on the default error page
+	Message string `json:"message,omitempty" yaml:"message"`
+	// RetryAfter (seconds) is sent in the Retry-After header (default 300)
+	RetryAfter int `json:"retry_after,omitempty" yaml:"retry_after"`
+	// Allow lists the CIDRs (or IPs) that skip the maintenance mode
+	Allow []string `json:"allow,omitempty" yaml:"allow"`
+	// Requests with BypassHeader set to BypassToken skip the maintenance
+	// mode (default header: X-Maintenance-Bypass)
+	BypassHeader string `json:"bypass_header,omitempty" yaml:"bypass_header"`
+	BypassToken  string `json:"bypass_token,omitempty" yaml:"bypass_token"`
+}
+
+// Maintenance is the maintenance state. It can be changed while serving.
+type Maintenance struct {
+	mu    sync.RWMutex
+	cfg   MaintenanceConfig
+	allow []*net.IPNet
+	page  []byte
+}
+
+// NewMaintenance creates the maintenance state (disabled if cfg is nil).
+func NewMaintenance(cfg *MaintenanceConfig) (*Maintenance, error) {
+	m := &Maintenance{}
+	if cfg == nil {
+		return m, nil
+	}
+	if err := m.Set(*cfg); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Set replaces the maintenance config.
+func (m *Maintenance) Set(cfg MaintenanceConfig) error {
+	allow, err := ipacl.ParseNets(cfg.Allow)
+	if err != nil {
+		return errors.Wrap(err, "maintenance allow")
+	}
+	var page []byte
+	if cfg.Page != "" {
+		if page, err = os.ReadFile(cfg.Page); err != nil {
+			return errors.Wrap(err, "maintenance page")
+		}
+	}
+	if cfg.RetryAfter <= 0 {
+		cfg.RetryAfter = 300
+	}
+	if cfg.BypassHeader == "" {
+		cfg.BypassHeader = "X-Maintenance-Bypass"
+	}
+	m.mu.Lock()
+	m.cfg = cfg
+	m.allow = allow
+	m.page = page
+	m.mu.Unlock()
+	return nil
+}
+
+// Config returns the current maintenance config.
+func (m *Maintenance) Config() MaintenanceConfig {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.cfg
+}
+
+// Serve writes the maintenance response (503) and returns true if the
+// request must not pass.
+func (m *Maintenance) Serve(w http.ResponseWriter, r *http.Request, clientIP net.IP, pages *errorpage.Pages) bool {
+	if m == nil {
+		return false
+	}
+	m.mu.RLock()
+	cfg, allow, page := m.cfg, m.allow, m.page
+	m.mu.RUnlock()
+	if !cfg.Enabled {
+		return false
+	}
+	if clientIP != nil && ipacl.Contains(allow, clientIP) {
+		return false
+	}
+	if cfg.BypassToken != "" {
+		v := r.Header.Get(cfg.BypassHeader)
+		if subtle.ConstantTimeCompare([]byte(v), []byte(cfg.BypassToken)) == 1 {
+			return false
+		}
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(cfg.RetryAfter))
+	if page != nil {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write(page)
+		return true
+	}
+	pages.Write(w, r, http.StatusServiceUnavailable, cfg.Message)
+	return true
+}
@@ -0,0 +1,77 @@
+package route
+
+import (
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gabstv/sandpiper/pkg/util"
+	"github.com/pkg/errors"
+)
+
+// MirrorConfig copies a share of the route traffic to a shadow upstream.
+// The shadow responses are discarded.
+type MirrorConfig struct {
+	// URL of the shadow upstream, e.g. http://10.0.0.5:8080
+	URL string `json:"url" yaml:"url"`
+	// Percent of the requests to copy (0-100)
+	Percent float64 `json:"percent" yaml:"percent"`
+	// MaxBodyBytes is the largest body that is buffered and copied.
+	// Requests with larger bodies are not mirrored. (default 1MB)
+	MaxBodyBytes int64 `json:"max_body_bytes,omitempty" yaml:"max_body_bytes"`
+	// Timeout (seconds) of each shadow request (default 10)
+	Timeout int `json:"timeout,omitempty" yaml:"timeout"`
+	// MaxConcurrent shadow requests; extra requests are dropped (default 100)
+	MaxConcurrent int `json:"max_concurrent,omitempty" yaml:"max_concurrent"`
+}
+
+type mirror struct {
+	cfg    MirrorConfig
+	shadow *util.Shadow
+}
+
+// SetupMirror creates the shadow upstream of the route.
+// observe (optional) receives the status and latency of the shadow requests.
+func (r *Route) SetupMirror(observe func(status int, latency time.Duration, err error)) error {
+	r.mirror = nil
+	if r.Mirror == nil || r.Mirror.Percent <= 0 {
+		return nil
+	}
+	cfg := *r.Mirror
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return errors.Wrap(err, "mirror url")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.Errorf("mirror url %q must be http or https", cfg.URL)
+	}
+	if cfg.MaxBodyBytes <= 0 {
+		cfg.MaxBodyBytes = 1 << 20
+	}
+	shadow := util.NewShadow(u, cfg.MaxConcurrent)
+	shadow.Transport = r.transport.NewTransport(nil)
+	shadow.Timeout = time.Duration(cfg.Timeout) * time.Second
+	shadow.Observe = observe
+	r.mirror = &mirror{
+		cfg:    cfg,
+		shadow: shadow,
+	}
+	return nil
+}
+
+// send copies the request to the shadow upstream if it is sampled
+func (m *mirror) send(req *http.Request) {
+	if m == nil || rand.Float64()*100 >= m.cfg.Percent {
+		return
+	}
+	if strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		return
+	}
+	body, ok := util.BufferBody(req, m.cfg.MaxBodyBytes)
+	if !ok {
+		return
+	}
+	m.shadow.Send(req, body)
+}
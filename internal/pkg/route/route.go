@@ -2,12 +2,16 @@ package route
 
 import (
 	"crypto/tls"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
 	"strings"
 	"time"
 
+	"github.com/gabstv/sandpiper/internal/pkg/ipacl"
+	"github.com/gabstv/sandpiper/pkg/errorpage"
+	"github.com/gabstv/sandpiper/pkg/ratelimit"
 	"github.com/gabstv/sandpiper/pkg/util"
 )
 
@@ -25,6 +29,8 @@ const (
 	REDIRECT ConnType = 3
 	// LOAD_BALANCER - Load balancer mode
 	LOAD_BALANCER ConnType = 4
+	// SPLIT - Weighted split between upstream groups (canary releases)
+	SPLIT ConnType = 5
 )
 
 func ParseConnType(v string) ConnType {
@@ -39,6 +45,8 @@ func ParseConnType(v string) ConnType {
 		return REDIRECT
 	case "LOAD_BALANCER", "4":
 		return LOAD_BALANCER
+	case "SPLIT", "5":
+		return SPLIT
 	}
 	return HTTP
 }
@@ -51,17 +59,61 @@ var defaultWebsocks = util.WsConfig{
 }
 
 type Route struct {
-	Domain        string           `json:"domain" yaml:"domain"`
-	Server        RouteServer      `json:"server" yaml:"server"`
-	Certificate   util.Certificate `json:"certificate" yaml:"certificate"`
-	Autocert      bool             `json:"autocert" yaml:"autocert"`
-	WsCFG         util.WsConfig    `json:"wscfg" yaml:"wscfg"`
+	Domain      string           `json:"domain" yaml:"domain"`
+	Server      RouteServer      `json:"server" yaml:"server"`
+	Certificate util.Certificate `json:"certificate" yaml:"certificate"`
+	Autocert    bool             `json:"autocert" yaml:"autocert"`
+	// AutocertDNS obtains the certificate with ACME DNS-01 challenges
+	// (required for wildcard domains)
+	AutocertDNS   bool          `json:"autocert_dns,omitempty" yaml:"autocert_dns"`
+	WsCFG         util.WsConfig `json:"wscfg" yaml:"wscfg"`
 	fn            func(w http.ResponseWriter, r *http.Request)
 	AuthMode      string `json:"auth_mode" yaml:"auth_mode"`
 	AuthKey       string `json:"auth_key" yaml:"auth_key"`
 	AuthValue     string `json:"auth_value" yaml:"auth_value"`
 	ForceHTTPS    bool   `json:"force_https" yaml:"force_https"`
 	FlushInterval int    `json:"flush_interval" yaml:"flush_interval"`
+	// Allow and Deny are lists of CIDRs (or IPs) checked against the client address
+	Allow      []string `json:"allow,omitempty" yaml:"allow"`
+	Deny       []string `json:"deny,omitempty" yaml:"deny"`
+	DenyStatus int      `json:"deny_status,omitempty" yaml:"deny_status"`
+	acl        *ipacl.ACL
+	// RateLimit (optional) limits the requests per client
+	RateLimit *ratelimit.Config `json:"rate_limit,omitempty" yaml:"rate_limit"`
+	limiter   *ratelimit.Limiter
+	// MaxBodyBytes and MaxHeaderBytes override the server defaults (0 = default)
+	MaxBodyBytes   int64 `json:"max_body_bytes,omitempty" yaml:"max_body_bytes"`
+	MaxHeaderBytes int   `json:"max_header_bytes,omitempty" yaml:"max_header_bytes"`
+	// ReadTimeout and WriteTimeout (seconds) override the server timeouts
+	ReadTimeout  int `json:"read_timeout,omitempty" yaml:"read_timeout"`
+	WriteTimeout int `json:"write_timeout,omitempty" yaml:"write_timeout"`
+	// Transport configures the connection to the upstream
+	Transport *TransportConfig `json:"transport,omitempty" yaml:"transport"`
+	transport TransportConfig
+	// UpstreamTLS configures the connection to HTTPS upstreams
+	UpstreamTLS *UpstreamTLSConfig `json:"upstream_tls,omitempty" yaml:"upstream_tls"`
+	tlsConfig   *tls.Config
+	pins        *pinVerifier
+	// AccessLog overrides the global access log setting
+	AccessLog *bool `json:"access_log,omitempty" yaml:"access_log"`
+	// ErrorPages overrides the global error pages
+	ErrorPages *errorpage.Config `json:"error_pages,omitempty" yaml:"error_pages"`
+	errorPages *errorpage.Pages
+	// Maintenance puts the route in maintenance mode
+	Maintenance *MaintenanceConfig `json:"maintenance,omitempty" yaml:"maintenance"`
+	maintenance *Maintenance
+	// Mirror copies a share of the requests to a shadow upstream
+	Mirror *MirrorConfig `json:"mirror,omitempty" yaml:"mirror"`
+	mirror *mirror
+	split  *splitter
+	// Rules send matching requests to other upstreams (before the route
+	// server of any type)
+	Rules  []MatchRule `json:"rules,omitempty" yaml:"rules"`
+	rules  []*matchRule
+	lb     *loadBalancer
+	logger *slog.Logger
+	// DisableHTTP2 negotiates HTTP/1.1 with the TLS clients of the route
+	DisableHTTP2 bool `json:"disable_http2,omitempty" yaml:"disable_http2"`
 }
 
 func (r *Route) SetupWsCfgDefaults() {
@@ -80,10 +132,141 @@ func (r *Route) SetupWsCfgDefaults() {
 	}
 }
 
+// SetLogger sets the logger of the route proxies (default: slog.Default())
+func (r *Route) SetLogger(l *slog.Logger) {
+	r.logger = l
+}
+
+// SetupErrorPages loads the route error pages. Routes without their own
+// config use the global pages.
+func (r *Route) SetupErrorPages(global *errorpage.Pages) error {
+	r.errorPages = global
+	if r.ErrorPages == nil {
+		return nil
+	}
+	p, err := errorpage.New(*r.ErrorPages)
+	if err != nil {
+		return err
+	}
+	r.errorPages = p
+	return nil
+}
+
+// SetupMaintenance loads the maintenance config
+func (r *Route) SetupMaintenance() error {
+	m, err := NewMaintenance(r.Maintenance)
+	if err != nil {
+		return err
+	}
+	r.maintenance = m
+	return nil
+}
+
+// SetMaintenance changes the maintenance mode of the route
+func (r *Route) SetMaintenance(cfg MaintenanceConfig) error {
+	if r.maintenance == nil {
+		if err := r.SetupMaintenance(); err != nil {
+			return err
+		}
+	}
+	return r.maintenance.Set(cfg)
+}
+
+// MaintenanceConfig returns the current maintenance config of the route
+func (r *Route) MaintenanceConfig() MaintenanceConfig {
+	if r.maintenance == nil {
+		return MaintenanceConfig{}
+	}
+	return r.maintenance.Config()
+}
+
+// ServeMaintenance writes the maintenance page and returns true if the
+// route is in maintenance mode (and the request can't bypass it)
+func (r *Route) ServeMaintenance(w http.ResponseWriter, req *http.Request, clientIP net.IP) bool {
+	return r.maintenance.Serve(w, req, clientIP, r.errorPages)
+}
+
+// WriteError writes an error page of the route
+func (r *Route) WriteError(w http.ResponseWriter, req *http.Request, status int, detail string) {
+	r.errorPages.Write(w, req, status, detail)
+}
+
+func (r *Route) upstreamError(w http.ResponseWriter, req *http.Request, err error) {
+	r.WriteError(w, req, util.UpstreamStatus(err), err.Error())
+}
+
+// SetupACL parses the Allow and Deny lists
+func (r *Route) SetupACL() error {
+	acl, err := ipacl.New(r.Allow, r.Deny)
+	if err != nil {
+		return err
+	}
+	r.acl = acl
+	return nil
+}
+
+// Allowed reports whether the client ip may use this route
+func (r *Route) Allowed(ip net.IP) bool {
+	return r.acl.Allowed(ip)
+}
+
+// SetupLimits creates the rate limiter. The store may be nil (in memory).
+func (r *Route) SetupLimits(store ratelimit.Store) {
+	r.limiter = nil
+	if r.RateLimit != nil && r.RateLimit.Rate > 0 {
+		r.limiter = ratelimit.New(r.Domain, *r.RateLimit, store)
+	}
+}
+
+// TakeRateLimit consumes a token of the client bucket. It returns false if
+// the route has no rate limit.
+func (r *Route) TakeRateLimit(req *http.Request, clientIP net.IP) (ratelimit.Result, bool) {
+	if r.limiter == nil {
+		return ratelimit.Result{}, false
+	}
+	return r.limiter.Take(req, clientIP), true
+}
+
+// limitConns applies Server.MaxConcurrent to the proxy of an upstream.
+// Each upstream (route server, load balancer, split and rule target) has
+// its own limit.
+func (r *Route) limitConns(rp *util.ReverseProxy) {
+	if r.Server.MaxConcurrent <= 0 {
+		return
+	}
+	rp.Conns = make(chan struct{}, r.Server.MaxConcurrent)
+	rp.Busy = func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Retry-After", "1")
+		r.WriteError(w, req, http.StatusServiceUnavailable, "too many concurrent requests")
+	}
+}
+
+// SetupTransport merges the route Transport with the server defaults and
+// loads the UpstreamTLS files
+func (r *Route) SetupTransport(defaults TransportConfig) error {
+	r.transport = defaults.Override(r.Transport)
+	r.tlsConfig = nil
+	r.pins = nil
+	if r.UpstreamTLS != nil {
+		cfg, pins, err := r.UpstreamTLS.tlsConfig()
+		if err != nil {
+			return err
+		}
+		r.tlsConfig = cfg
+		r.pins = pins
+	}
+	return nil
+}
+
 type RouteServer struct {
 	OutConnType  ConnType            `json:"out_conn_type" yaml:"out_conn_type"`
 	OutAddress   string              `json:"out_address,omitempty" yaml:"out_address"`
 	LoadBalancer *LoadBalancerConfig `json:"load_balancer,omitempty" yaml:"load_balancer"`
+	// Split is used by SPLIT routes
+	Split *SplitConfig `json:"split,omitempty" yaml:"split"`
+	// MaxConcurrent limits the in-flight requests to each upstream target
+	// (0 = unlimited)
+	MaxConcurrent int `json:"max_concurrent,omitempty" yaml:"max_concurrent"`
 }
 
 func (rs *RouteServer) URL() *url.URL {
@@ -103,48 +286,37 @@ func (rt *Route) ReverseProxy(w http.ResponseWriter, r *http.Request) {
 		if rt.Server.OutConnType == REDIRECT {
 			base, err := url.Parse(rt.Server.OutAddress)
 			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write([]byte("Could not redirect (invalid URL); " + err.Error()))
+				rt.WriteError(w, r, http.StatusInternalServerError, "could not redirect (invalid URL); "+err.Error())
 				return
 			}
 			rt.fn = func(w http.ResponseWriter, r *http.Request) {
 				url1, err := url.Parse(r.URL.Path)
 				if err != nil {
-					w.WriteHeader(http.StatusInternalServerError)
-					w.Write([]byte("Could not redirect (invalid path); " + err.Error()))
+					rt.WriteError(w, r, http.StatusInternalServerError, "could not redirect (invalid path); "+err.Error())
 					return
 				}
 				url2 := base.ResolveReference(url1)
 				http.Redirect(w, r, url2.String(), http.StatusPermanentRedirect)
 			}
 		} else if rt.Server.OutConnType == LOAD_BALANCER {
-			if rt.Server.LoadBalancer == nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write([]byte("could not serve (load balancer configuration is nil)"))
+			if rt.lb == nil {
+				rt.WriteError(w, r, http.StatusInternalServerError, "could not serve (load balancer configuration is nil)")
 				return
 			}
-			lblb := &loadBalancer{}
-			lblb.Targets = make([]*loadBalancerTarget, 0)
-			for _, v := range rt.Server.LoadBalancer.Targets {
-				lbt := &loadBalancerTarget{
-					Path:        v.Path,
-					HealthScore: 100,
-					Count:       0,
-				}
-				rp := util.NewSingleHostReverseProxy(lbt.URL(), defaultWebsocks, time.Second)
-				lbt.Proxy = rp
-				lblb.Targets = append(lblb.Targets, lbt)
-			}
-			rt.fn = func(w http.ResponseWriter, r *http.Request) {
-				lblb.ServeHTTP(w, r)
+			rt.fn = rt.lb.ServeHTTP
+		} else if rt.Server.OutConnType == SPLIT {
+			if rt.split == nil {
+				rt.WriteError(w, r, http.StatusInternalServerError, "could not serve (split configuration is nil)")
+				return
 			}
+			rt.fn = rt.split.ServeHTTP
 		} else {
 			rp := buildReverseProxy(rt)
 			if rt.ForceHTTPS {
 				// println("FORCE HTTPS " + rt.Domain)
 				rt.fn = func(w http.ResponseWriter, r *http.Request) {
 					// spew.Dump(r)
-					if r.TLS == nil || r.Header.Get("X-Forwarded-Proto") == "http" {
+					if rt.redirectHTTPS(r) {
 						url2 := *r.URL
 						url2.Scheme = "https"
 						url2.Host = r.Host
@@ -160,18 +332,48 @@ func (rt *Route) ReverseProxy(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 	}
+	rt.mirror.send(r)
+	if rp := rt.ruleProxy(r); rp != nil && !rt.redirectHTTPS(r) {
+		rp.ServeHTTP(w, r)
+		return
+	}
 	rt.fn(w, r)
 }
 
+// redirectHTTPS reports whether a ForceHTTPS route must redirect r
+func (rt *Route) redirectHTTPS(r *http.Request) bool {
+	return rt.ForceHTTPS && (r.TLS == nil || r.Header.Get("X-Forwarded-Proto") == "http")
+}
+
 func buildReverseProxy(rt *Route) *util.ReverseProxy {
 	rp := util.NewSingleHostReverseProxy(rt.Server.URL(), rt.WsCFG, time.Duration(rt.FlushInterval)*time.Second)
-	if rt.Server.OutConnType == HTTPS_SKIP_VERIFY {
-		rp.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-			Dial: func(network, addr string) (net.Conn, error) {
-				return net.DialTimeout(network, addr, time.Duration(60*time.Second))
-			},
+	rp.Transport = buildTransport(rt)
+	rp.DialTimeout = rt.transport.dialTimeout()
+	rp.Logger = rt.logger
+	rp.ErrorHandler = rt.upstreamError
+	rt.limitConns(rp)
+	return rp
+}
+
+func buildTransport(rt *Route) http.RoundTripper {
+	var tlsConfig *tls.Config
+	if rt.tlsConfig != nil {
+		tlsConfig = rt.tlsConfig.Clone()
+	}
+	skipVerify := rt.Server.OutConnType == HTTPS_SKIP_VERIFY
+	if skipVerify {
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
 		}
+		tlsConfig.InsecureSkipVerify = true
 	}
-	return rp
+	tr := rt.transport.NewTransport(tlsConfig)
+	if skipVerify {
+		// HTTPS_SKIP_VERIFY routes never used the environment proxy
+		tr.Proxy = nil
+	}
+	if rt.pins != nil {
+		tr.DialTLSContext = rt.pins.dialTLS(tr)
+	}
+	return tr
 }
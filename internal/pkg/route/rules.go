@@ -0,0 +1,189 @@
+package route
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gabstv/sandpiper/internal/pkg/ipacl"
+	"github.com/gabstv/sandpiper/pkg/util"
+	"github.com/pkg/errors"
+)
+
+// MatchRule sends the requests that match all of its conditions to another
+// upstream. Rules are evaluated in order; the first match wins and requests
+// that match no rule use the route server. Rules are evaluated before the
+// route server of any type, so they also take over REDIRECT, SPLIT and
+// LOAD_BALANCER routes.
+type MatchRule struct {
+	Name string `json:"name,omitempty" yaml:"name"`
+	// Methods (any of)
+	Methods []string `json:"methods,omitempty" yaml:"methods"`
+	// Headers maps a header name to a regular expression. The expressions
+	// must match the whole value.
+	Headers map[string]string `json:"headers,omitempty" yaml:"headers"`
+	// Query maps a query param to a regular expression (whole value)
+	Query map[string]string `json:"query,omitempty" yaml:"query"`
+	// Cookies that must be present
+	Cookies []string `json:"cookies,omitempty" yaml:"cookies"`
+	// CIDRs of the client address (any of)
+	CIDRs []string `json:"cidrs,omitempty" yaml:"cidrs"`
+	// Upstream url, e.g. http://10.0.0.9:8080
+	Upstream string `json:"upstream" yaml:"upstream"`
+}
+
+type matchRule struct {
+	methods []string
+	headers map[string]*regexp.Regexp
+	query   map[string]*regexp.Regexp
+	cookies []string
+	nets    []*net.IPNet
+	proxy   *util.ReverseProxy
+}
+
+// SetupRules compiles the match rules of the route
+func (r *Route) SetupRules() error {
+	r.rules = nil
+	if len(r.Rules) == 0 {
+		return nil
+	}
+	transport := buildTransport(r)
+	rules := make([]*matchRule, 0, len(r.Rules))
+	for i, v := range r.Rules {
+		name := v.Name
+		if name == "" {
+			name = "#" + strconv.Itoa(i+1)
+		}
+		mr, err := compileRule(v)
+		if err != nil {
+			return errors.Wrapf(err, "rule %v", name)
+		}
+		u, err := url.Parse(v.Upstream)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.Errorf("rule %v: invalid upstream %q", name, v.Upstream)
+		}
+		rp := util.NewSingleHostReverseProxy(u, r.WsCFG, time.Duration(r.FlushInterval)*time.Second)
+		rp.Transport = transport
+		rp.DialTimeout = r.transport.dialTimeout()
+		rp.Logger = r.logger
+		rp.ErrorHandler = r.upstreamError
+		r.limitConns(rp)
+		mr.proxy = rp
+		rules = append(rules, mr)
+	}
+	r.rules = rules
+	return nil
+}
+
+func compileRule(v MatchRule) (*matchRule, error) {
+	mr := &matchRule{
+		cookies: v.Cookies,
+		headers: make(map[string]*regexp.Regexp),
+		query:   make(map[string]*regexp.Regexp),
+	}
+	for _, m := range v.Methods {
+		mr.methods = append(mr.methods, strings.ToUpper(m))
+	}
+	for k, expr := range v.Headers {
+		re, err := compileValue(expr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "header %v", k)
+		}
+		mr.headers[http.CanonicalHeaderKey(k)] = re
+	}
+	for k, expr := range v.Query {
+		re, err := compileValue(expr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "query %v", k)
+		}
+		mr.query[k] = re
+	}
+	nets, err := ipacl.ParseNets(v.CIDRs)
+	if err != nil {
+		return nil, err
+	}
+	mr.nets = nets
+	return mr, nil
+}
+
+// compileValue anchors expr so that "2" does not match "12"
+func compileValue(expr string) (*regexp.Regexp, error) {
+	// compiled alone first, so that expr cannot close the group (e.g. "a)|(b")
+	if _, err := regexp.Compile(expr); err != nil {
+		return nil, err
+	}
+	return regexp.Compile("^(?:" + expr + ")$")
+}
+
+func (mr *matchRule) match(req *http.Request) bool {
+	if len(mr.methods) > 0 && !containsString(mr.methods, req.Method) {
+		return false
+	}
+	for k, re := range mr.headers {
+		vv, ok := req.Header[k]
+		if !ok || !matchAny(re, vv) {
+			return false
+		}
+	}
+	if len(mr.query) > 0 {
+		q := req.URL.Query()
+		for k, re := range mr.query {
+			vv, ok := q[k]
+			if !ok || !matchAny(re, vv) {
+				return false
+			}
+		}
+	}
+	for _, name := range mr.cookies {
+		if _, err := req.Cookie(name); err != nil {
+			return false
+		}
+	}
+	if len(mr.nets) > 0 {
+		ip := requestIP(req)
+		if ip == nil || !ipacl.Contains(mr.nets, ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// ruleProxy returns the proxy of the first rule that matches req
+func (r *Route) ruleProxy(req *http.Request) *util.ReverseProxy {
+	for _, mr := range r.rules {
+		if mr.match(req) {
+			return mr.proxy
+		}
+	}
+	return nil
+}
+
+// requestIP returns the client ip resolved by the server (or RemoteAddr)
+func requestIP(req *http.Request) net.IP {
+	if info := util.GetRequestInfo(req.Context()); info != nil && info.ClientIP != nil {
+		return info.ClientIP
+	}
+	return ipacl.ClientIP(req, nil)
+}
+
+func matchAny(re *regexp.Regexp, values []string) bool {
+	for _, v := range values {
+		if re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, v string) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
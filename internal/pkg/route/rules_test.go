@@ -0,0 +1,138 @@
+package route
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRules(t *testing.T) {
+	upstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+	}
+	def, v2, internal := upstream("default"), upstream("v2"), upstream("internal")
+	defer def.Close()
+	defer v2.Close()
+	defer internal.Close()
+
+	rt := &Route{
+		Domain: "rules.example.com",
+		Server: RouteServer{
+			OutConnType: HTTP,
+			OutAddress:  strings.TrimPrefix(def.URL, "http://"),
+		},
+		Rules: []MatchRule{
+			{
+				Name:     "v2",
+				Methods:  []string{"get", "post"},
+				Headers:  map[string]string{"x-api-version": "2"},
+				Upstream: v2.URL,
+			},
+			{
+				Name:     "internal",
+				Query:    map[string]string{"debug": "1|true"},
+				Cookies:  []string{"session"},
+				CIDRs:    []string{"10.0.0.0/8"},
+				Upstream: internal.URL,
+			},
+		},
+	}
+	if err := rt.SetupRules(); err != nil {
+		t.Fatal(err)
+	}
+	get := func(method, target, remote string, set func(r *http.Request)) string {
+		r := httptest.NewRequest(method, target, nil)
+		r.RemoteAddr = remote
+		if set != nil {
+			set(r)
+		}
+		w := httptest.NewRecorder()
+		rt.ReverseProxy(w, r)
+		return w.Body.String()
+	}
+	version2 := func(r *http.Request) { r.Header.Set("X-Api-Version", "2") }
+	version12 := func(r *http.Request) { r.Header.Set("X-Api-Version", "12") }
+	session := func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "session", Value: "x"}) }
+	cases := []struct {
+		name, method, target, remote string
+		set                          func(r *http.Request)
+		want                         string
+	}{
+		{"no rule", "GET", "/", "1.2.3.4:1", nil, "default"},
+		{"header", "GET", "/", "1.2.3.4:1", version2, "v2"},
+		{"whole header value", "GET", "/", "1.2.3.4:1", version12, "default"},
+		{"method", "DELETE", "/", "1.2.3.4:1", version2, "default"},
+		{"all conditions", "GET", "/?debug=1", "10.1.1.1:1", session, "internal"},
+		{"alternation", "GET", "/?debug=true", "10.1.1.1:1", session, "internal"},
+		{"whole query value", "GET", "/?debug=10", "10.1.1.1:1", session, "default"},
+		{"cidr", "GET", "/?debug=1", "1.2.3.4:1", session, "default"},
+		{"cookie", "GET", "/?debug=1", "10.1.1.1:1", nil, "default"},
+	}
+	for _, c := range cases {
+		if v := get(c.method, c.target, c.remote, c.set); v != c.want {
+			t.Fatalf("%v: should be served by %q but it was %q", c.name, c.want, v)
+		}
+	}
+
+	for _, expr := range []string{"(", "a)|(b"} {
+		rt.Rules = []MatchRule{{Headers: map[string]string{"a": expr}, Upstream: v2.URL}}
+		if err := rt.SetupRules(); err == nil {
+			t.Fatalf("invalid regexp %q should return an error", expr)
+		}
+	}
+}
+
+func TestRulesOverrideRouteType(t *testing.T) {
+	rule := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("rule"))
+	}))
+	defer rule.Close()
+	rules := []MatchRule{{Headers: map[string]string{"X-Canary": "1"}, Upstream: rule.URL}}
+
+	routes := map[string]*Route{
+		"redirect": {
+			Domain: "redirect.example.com",
+			Server: RouteServer{OutConnType: REDIRECT, OutAddress: "https://other.example.com"},
+			Rules:  rules,
+		},
+		"load balancer": {
+			Domain: "lb.example.com",
+			Server: RouteServer{
+				OutConnType:  LOAD_BALANCER,
+				LoadBalancer: &LoadBalancerConfig{Targets: []LoadBalancerTargetCfg{{Path: "127.0.0.1:1"}}},
+			},
+			Rules: rules,
+		},
+		"split": {
+			Domain: "split.example.com",
+			Server: RouteServer{
+				OutConnType: SPLIT,
+				Split: &SplitConfig{Groups: []UpstreamGroup{
+					{Name: "stable", Weight: 100, Targets: []string{"http://127.0.0.1:1"}},
+				}},
+			},
+			Rules: rules,
+		},
+	}
+	for name, rt := range routes {
+		if err := rt.SetupLoadBalancer(); err != nil {
+			t.Fatal(err)
+		}
+		if err := rt.SetupSplit(); err != nil {
+			t.Fatal(err)
+		}
+		if err := rt.SetupRules(); err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Canary", "1")
+		w := httptest.NewRecorder()
+		rt.ReverseProxy(w, r)
+		if w.Body.String() != "rule" {
+			t.Fatalf("%v: the rule should take precedence over the route server, got %v %q", name, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package route
+
+import (
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gabstv/sandpiper/pkg/util"
+	"github.com/pkg/errors"
+)
+
+// SplitConfig splits the route traffic between named upstream groups
+// (e.g. 95% stable / 5% canary).
+type SplitConfig struct {
+	Groups []UpstreamGroup `json:"groups" yaml:"groups"`
+	// Header forces a group when the request sets it to the group name
+	Header string `json:"header,omitempty" yaml:"header"`
+	// Cookie forces a group when the request sets it to the group name
+	Cookie string `json:"cookie,omitempty" yaml:"cookie"`
+}
+
+// UpstreamGroup is a named set of upstreams. The requests of a group are
+// balanced between its targets.
+type UpstreamGroup struct {
+	Name   string `json:"name" yaml:"name"`
+	Weight int    `json:"weight" yaml:"weight"`
+	// Targets are upstream urls, e.g. http://10.0.0.5:8080
+	Targets []string `json:"targets" yaml:"targets"`
+}
+
+type splitter struct {
+	mu     sync.RWMutex
+	groups []*splitGroup
+	total  int
+	header string
+	cookie string
+}
+
+type splitGroup struct {
+	name    string
+	weight  int
+	proxies []*util.ReverseProxy
+	next    uint32
+}
+
+// SetupSplit builds the upstream groups of a SPLIT route
+func (r *Route) SetupSplit() error {
+	r.split = nil
+	if r.Server.OutConnType != SPLIT {
+		return nil
+	}
+	cfg := r.Server.Split
+	if cfg == nil || len(cfg.Groups) == 0 {
+		return errors.New("split: no upstream groups")
+	}
+	sp := &splitter{
+		header: cfg.Header,
+		cookie: cfg.Cookie,
+	}
+	transport := buildTransport(r)
+	names := make(map[string]bool)
+	for _, g := range cfg.Groups {
+		if g.Name == "" || names[g.Name] {
+			return errors.Errorf("split: invalid or duplicated group name %q", g.Name)
+		}
+		names[g.Name] = true
+		if g.Weight < 0 {
+			return errors.Errorf("split: group %v: negative weight", g.Name)
+		}
+		if len(g.Targets) == 0 {
+			return errors.Errorf("split: group %v: no targets", g.Name)
+		}
+		sg := &splitGroup{
+			name:   g.Name,
+			weight: g.Weight,
+		}
+		for _, t := range g.Targets {
+			u, err := url.Parse(t)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return errors.Errorf("split: group %v: invalid target %q", g.Name, t)
+			}
+			rp := util.NewSingleHostReverseProxy(u, r.WsCFG, time.Duration(r.FlushInterval)*time.Second)
+			rp.Transport = transport
+			rp.DialTimeout = r.transport.dialTimeout()
+			rp.Logger = r.logger
+			rp.ErrorHandler = r.upstreamError
+			r.limitConns(rp)
+			sg.proxies = append(sg.proxies, rp)
+		}
+		sp.groups = append(sp.groups, sg)
+		sp.total += g.Weight
+	}
+	if sp.total <= 0 {
+		return errors.New("split: the sum of the weights must be positive")
+	}
+	r.split = sp
+	return nil
+}
+
+// SplitWeights returns the current weight of each upstream group
+func (r *Route) SplitWeights() map[string]int {
+	weights := make(map[string]int)
+	if r.split == nil {
+		return weights
+	}
+	r.split.mu.RLock()
+	defer r.split.mu.RUnlock()
+	for _, g := range r.split.groups {
+		weights[g.name] = g.weight
+	}
+	return weights
+}
+
+// SetSplitWeights changes the weights of the upstream groups. Groups that
+// are not in weights keep their current weight.
+func (r *Route) SetSplitWeights(weights map[string]int) error {
+	if r.split == nil {
+		return errors.Errorf("route %v does not split traffic", r.Domain)
+	}
+	sp := r.split
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	next := make([]int, len(sp.groups))
+	total := 0
+	for i, g := range sp.groups {
+		next[i] = g.weight
+		if w, ok := weights[g.name]; ok {
+			next[i] = w
+		}
+		if next[i] < 0 {
+			return errors.Errorf("group %v: negative weight", g.name)
+		}
+		total += next[i]
+	}
+	for name := range weights {
+		if sp.group(name) == nil {
+			return errors.Errorf("group %v does not exist", name)
+		}
+	}
+	if total <= 0 {
+		return errors.New("the sum of the weights must be positive")
+	}
+	for i, g := range sp.groups {
+		g.weight = next[i]
+	}
+	sp.total = total
+	return nil
+}
+
+// group returns the group by name (the lock must be held)
+func (sp *splitter) group(name string) *splitGroup {
+	for _, g := range sp.groups {
+		if g.name == name {
+			return g
+		}
+	}
+	return nil
+}
+
+// pick returns the forced group (header or cookie) or a weighted random one
+func (sp *splitter) pick(req *http.Request) *splitGroup {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	if sp.header != "" {
+		if g := sp.group(req.Header.Get(sp.header)); g != nil {
+			return g
+		}
+	}
+	if sp.cookie != "" {
+		if c, err := req.Cookie(sp.cookie); err == nil {
+			if g := sp.group(c.Value); g != nil {
+				return g
+			}
+		}
+	}
+	n := rand.Intn(sp.total)
+	for _, g := range sp.groups {
+		if n < g.weight {
+			return g
+		}
+		n -= g.weight
+	}
+	return sp.groups[len(sp.groups)-1]
+}
+
+func (sp *splitter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	g := sp.pick(req)
+	i := atomic.AddUint32(&g.next, 1)
+	g.proxies[int(i)%len(g.proxies)].ServeHTTP(w, req)
+}
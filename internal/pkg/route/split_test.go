@@ -0,0 +1,71 @@
+package route
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	upstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+	}
+	stable, canary := upstream("stable"), upstream("canary")
+	defer stable.Close()
+	defer canary.Close()
+
+	rt := &Route{
+		Domain: "split.example.com",
+		Server: RouteServer{
+			OutConnType: SPLIT,
+			Split: &SplitConfig{
+				Header: "X-Canary",
+				Cookie: "group",
+				Groups: []UpstreamGroup{
+					{Name: "stable", Weight: 100, Targets: []string{stable.URL}},
+					{Name: "canary", Weight: 0, Targets: []string{canary.URL}},
+				},
+			},
+		},
+	}
+	if err := rt.SetupSplit(); err != nil {
+		t.Fatal(err)
+	}
+	get := func(set func(r *http.Request)) string {
+		r := httptest.NewRequest("GET", "/", nil)
+		if set != nil {
+			set(r)
+		}
+		w := httptest.NewRecorder()
+		rt.ReverseProxy(w, r)
+		return w.Body.String()
+	}
+	for i := 0; i < 10; i++ {
+		if v := get(nil); v != "stable" {
+			t.Fatalf("weight 0 group should not be picked, got %q", v)
+		}
+	}
+	if v := get(func(r *http.Request) { r.Header.Set("X-Canary", "canary") }); v != "canary" {
+		t.Fatalf("header should force the canary group, got %q", v)
+	}
+	if v := get(func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "group", Value: "canary"}) }); v != "canary" {
+		t.Fatalf("cookie should force the canary group, got %q", v)
+	}
+	if err := rt.SetSplitWeights(map[string]int{"stable": 0, "canary": 100}); err != nil {
+		t.Fatal(err)
+	}
+	if v := get(nil); v != "canary" {
+		t.Fatalf("canary should get all the traffic after the update, got %q", v)
+	}
+	if err := rt.SetSplitWeights(map[string]int{"canary": 0}); err == nil {
+		t.Fatal("all weights at 0 should return an error")
+	}
+	if err := rt.SetSplitWeights(map[string]int{"beta": 10}); err == nil {
+		t.Fatal("unknown group should return an error")
+	}
+	if w := rt.SplitWeights(); w["stable"] != 0 || w["canary"] != 100 {
+		t.Fatalf("unexpected weights %v", w)
+	}
+}
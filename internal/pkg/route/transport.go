@@ -0,0 +1,117 @@
+package route
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+)
+
+// TransportConfig configures the connection to the upstream.
+// Timeouts are in seconds (0 = default, -1 = none where noted).
+type TransportConfig struct {
+	DialTimeout           int `json:"dial_timeout,omitempty" yaml:"dial_timeout"`
+	TLSHandshakeTimeout   int `json:"tls_handshake_timeout,omitempty" yaml:"tls_handshake_timeout"`
+	ResponseHeaderTimeout int `json:"response_header_timeout,omitempty" yaml:"response_header_timeout"`
+	// KeepAlive is the TCP keep-alive period (-1 disables it)
+	KeepAlive int `json:"keep_alive,omitempty" yaml:"keep_alive"`
+	// IdleConnTimeout closes idle connections (-1 keeps them open)
+	IdleConnTimeout int `json:"idle_conn_timeout,omitempty" yaml:"idle_conn_timeout"`
+	// ExpectContinueTimeout waits for a 100-continue (-1 sends the body
+	// immediately)
+	ExpectContinueTimeout int `json:"expect_continue_timeout,omitempty" yaml:"expect_continue_timeout"`
+	MaxIdleConns          int `json:"max_idle_conns,omitempty" yaml:"max_idle_conns"`
+	MaxIdleConnsPerHost   int `json:"max_idle_conns_per_host,omitempty" yaml:"max_idle_conns_per_host"`
+	MaxConnsPerHost       int `json:"max_conns_per_host,omitempty" yaml:"max_conns_per_host"`
+	// HTTP2 enables (default) or disables HTTP/2 to HTTPS upstreams
+	HTTP2 *bool `json:"http2,omitempty" yaml:"http2"`
+}
+
+// Override returns a copy of t with the non-zero fields of o.
+func (t TransportConfig) Override(o *TransportConfig) TransportConfig {
+	if o == nil {
+		return t
+	}
+	if o.DialTimeout != 0 {
+		t.DialTimeout = o.DialTimeout
+	}
+	if o.TLSHandshakeTimeout != 0 {
+		t.TLSHandshakeTimeout = o.TLSHandshakeTimeout
+	}
+	if o.ResponseHeaderTimeout != 0 {
+		t.ResponseHeaderTimeout = o.ResponseHeaderTimeout
+	}
+	if o.KeepAlive != 0 {
+		t.KeepAlive = o.KeepAlive
+	}
+	if o.IdleConnTimeout != 0 {
+		t.IdleConnTimeout = o.IdleConnTimeout
+	}
+	if o.ExpectContinueTimeout != 0 {
+		t.ExpectContinueTimeout = o.ExpectContinueTimeout
+	}
+	if o.MaxIdleConns != 0 {
+		t.MaxIdleConns = o.MaxIdleConns
+	}
+	if o.MaxIdleConnsPerHost != 0 {
+		t.MaxIdleConnsPerHost = o.MaxIdleConnsPerHost
+	}
+	if o.MaxConnsPerHost != 0 {
+		t.MaxConnsPerHost = o.MaxConnsPerHost
+	}
+	if o.HTTP2 != nil {
+		t.HTTP2 = o.HTTP2
+	}
+	return t
+}
+
+// NewTransport builds the http.Transport. tlsConfig may be nil.
+func (t TransportConfig) NewTransport(tlsConfig *tls.Config) *http.Transport {
+	keepAlive := seconds(t.KeepAlive, 30)
+	if t.KeepAlive < 0 {
+		keepAlive = -1
+	}
+	tr := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   t.dialTimeout(),
+			KeepAlive: keepAlive,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   seconds(t.TLSHandshakeTimeout, 10),
+		ResponseHeaderTimeout: seconds(t.ResponseHeaderTimeout, 0),
+		IdleConnTimeout:       secondsOrNone(t.IdleConnTimeout, 90),
+		ExpectContinueTimeout: secondsOrNone(t.ExpectContinueTimeout, 1),
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   t.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       t.MaxConnsPerHost,
+		ForceAttemptHTTP2:     t.HTTP2 == nil || *t.HTTP2,
+	}
+	if t.MaxIdleConns != 0 {
+		tr.MaxIdleConns = t.MaxIdleConns
+	}
+	if t.HTTP2 != nil && !*t.HTTP2 {
+		// a non-nil empty map disables the automatic HTTP/2 upgrade
+		tr.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return tr
+}
+
+func (t TransportConfig) dialTimeout() time.Duration {
+	return seconds(t.DialTimeout, 30)
+}
+
+func seconds(v, def int) time.Duration {
+	if v <= 0 {
+		v = def
+	}
+	return time.Duration(v) * time.Second
+}
+
+// secondsOrNone is seconds with -1 (any negative value) as zero
+func secondsOrNone(v, def int) time.Duration {
+	if v < 0 {
+		return 0
+	}
+	return seconds(v, def)
+}
@@ -0,0 +1,86 @@
+package route
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTransportOverride(t *testing.T) {
+	yes, no := true, false
+	defaults := TransportConfig{DialTimeout: 5, IdleConnTimeout: 30, MaxIdleConnsPerHost: 8, HTTP2: &no}
+	cases := []struct {
+		name     string
+		override *TransportConfig
+		want     TransportConfig
+	}{
+		{"nil keeps the defaults", nil, defaults},
+		{"zero fields keep the defaults", &TransportConfig{}, defaults},
+		{"non-zero fields win", &TransportConfig{DialTimeout: 1, MaxConnsPerHost: 4},
+			TransportConfig{DialTimeout: 1, IdleConnTimeout: 30, MaxIdleConnsPerHost: 8, MaxConnsPerHost: 4, HTTP2: &no}},
+		{"negative values win", &TransportConfig{IdleConnTimeout: -1, KeepAlive: -1},
+			TransportConfig{DialTimeout: 5, IdleConnTimeout: -1, KeepAlive: -1, MaxIdleConnsPerHost: 8, HTTP2: &no}},
+		{"http2 pointer wins", &TransportConfig{HTTP2: &yes},
+			TransportConfig{DialTimeout: 5, IdleConnTimeout: 30, MaxIdleConnsPerHost: 8, HTTP2: &yes}},
+	}
+	for _, c := range cases {
+		got := defaults.Override(c.override)
+		if got.HTTP2 != c.want.HTTP2 {
+			t.Fatalf("(%v) http2 should be %v", c.name, *c.want.HTTP2)
+		}
+		got.HTTP2, c.want.HTTP2 = nil, nil
+		if got != c.want {
+			t.Fatalf("(%v) got %+v, want %+v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestNewTransport(t *testing.T) {
+	no := false
+	cases := []struct {
+		name   string
+		cfg    TransportConfig
+		check  func(*http.Transport) bool
+		expect string
+	}{
+		{"defaults", TransportConfig{}, func(tr *http.Transport) bool {
+			return tr.TLSHandshakeTimeout == 10*time.Second && tr.ResponseHeaderTimeout == 0 &&
+				tr.IdleConnTimeout == 90*time.Second && tr.ExpectContinueTimeout == time.Second &&
+				tr.MaxIdleConns == 100 && tr.ForceAttemptHTTP2 && tr.TLSNextProto == nil
+		}, "the default timeouts and pool"},
+		{"custom", TransportConfig{TLSHandshakeTimeout: 3, ResponseHeaderTimeout: 7, IdleConnTimeout: 20,
+			ExpectContinueTimeout: 2, MaxIdleConns: 10, MaxIdleConnsPerHost: 5, MaxConnsPerHost: 6}, func(tr *http.Transport) bool {
+			return tr.TLSHandshakeTimeout == 3*time.Second && tr.ResponseHeaderTimeout == 7*time.Second &&
+				tr.IdleConnTimeout == 20*time.Second && tr.ExpectContinueTimeout == 2*time.Second &&
+				tr.MaxIdleConns == 10 && tr.MaxIdleConnsPerHost == 5 && tr.MaxConnsPerHost == 6
+		}, "the configured values"},
+		{"none", TransportConfig{IdleConnTimeout: -1, ExpectContinueTimeout: -1}, func(tr *http.Transport) bool {
+			return tr.IdleConnTimeout == 0 && tr.ExpectContinueTimeout == 0
+		}, "zero timeouts for -1"},
+		{"no http2", TransportConfig{HTTP2: &no}, func(tr *http.Transport) bool {
+			return !tr.ForceAttemptHTTP2 && tr.TLSNextProto != nil && len(tr.TLSNextProto) == 0
+		}, "HTTP/2 disabled"},
+	}
+	for _, c := range cases {
+		if tr := c.cfg.NewTransport(nil); !c.check(tr) {
+			t.Fatalf("(%v) expected %v: %+v", c.name, c.expect, tr)
+		}
+	}
+}
+
+func TestBuildTransportProxy(t *testing.T) {
+	cases := []struct {
+		connType ConnType
+		proxied  bool
+	}{
+		{HTTP, true},
+		{HTTPS_VERIFY, true},
+		{HTTPS_SKIP_VERIFY, false},
+	}
+	for _, c := range cases {
+		tr := buildTransport(&Route{Server: RouteServer{OutConnType: c.connType}}).(*http.Transport)
+		if (tr.Proxy != nil) != c.proxied {
+			t.Fatalf("(%v) the environment proxy should be used: %v", c.connType, c.proxied)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package route
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gabstv/sandpiper/pkg/util"
+)
+
+// UpstreamTLSConfig configures the TLS connection to HTTPS upstreams.
+type UpstreamTLSConfig struct {
+	// CAFile is a PEM bundle used instead of the system roots
+	CAFile string `json:"ca_file,omitempty" yaml:"ca_file"`
+	// CertFile and KeyFile are the client certificate (mTLS)
+	CertFile string `json:"cert_file,omitempty" yaml:"cert_file"`
+	KeyFile  string `json:"key_file,omitempty" yaml:"key_file"`
+	// ServerName overrides the name used for SNI and verification
+	ServerName string `json:"server_name,omitempty" yaml:"server_name"`
+	// MinVersion: "1.0", "1.1", "1.2" or "1.3"
+	MinVersion string `json:"min_version,omitempty" yaml:"min_version"`
+	// Pins are SHA-256 fingerprints (hex, colons allowed) of accepted
+	// certificates. If set, either the leaf matches a pin or the leaf
+	// must be issued (for ServerName, else the upstream host or IP) by a
+	// pinned certificate of the chain. The chain is also verified against
+	// CAFile if it is set.
+	Pins []string `json:"pins,omitempty" yaml:"pins"`
+}
+
+// TLSConfig builds the client tls.Config.
+func (c *UpstreamTLSConfig) TLSConfig() (*tls.Config, error) {
+	cfg, _, err := c.tlsConfig()
+	return cfg, err
+}
+
+func (c *UpstreamTLSConfig) tlsConfig() (*tls.Config, *pinVerifier, error) {
+	cfg := &tls.Config{
+		ServerName: c.ServerName,
+	}
+	if c.MinVersion != "" {
+		v, err := util.ParseTLSVersion(c.MinVersion)
+		if err != nil {
+			return nil, nil, err
+		}
+		cfg.MinVersion = v
+	}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("no certificates found in %v", c.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if len(c.Pins) == 0 {
+		return cfg, nil, nil
+	}
+	pv := &pinVerifier{roots: cfg.RootCAs}
+	for _, v := range c.Pins {
+		pin, err := hex.DecodeString(strings.Replace(strings.TrimSpace(v), ":", "", -1))
+		if err != nil || len(pin) != sha256.Size {
+			return nil, nil, fmt.Errorf("invalid sha256 pin %q", v)
+		}
+		pv.pins = append(pv.pins, pin)
+	}
+	cfg.InsecureSkipVerify = true
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		// cs.ServerName is empty for IP upstreams (no SNI); the route
+		// transport dials with dialTLS to verify them
+		name := c.ServerName
+		if name == "" {
+			name = cs.ServerName
+		}
+		return pv.verify(cs, name)
+	}
+	return cfg, pv, nil
+}
+
+var errUnknownUpstreamName = fmt.Errorf("upstream name is unknown, set the upstream tls server_name")
+
+// pinVerifier checks the upstream certificates against the pins (and the
+// CAFile roots, if set)
+type pinVerifier struct {
+	pins  [][]byte
+	roots *x509.CertPool
+}
+
+// verify checks the peer chain for name, a host name or an IP address
+// (matched against the IP SANs)
+func (p *pinVerifier) verify(cs tls.ConnectionState, name string) error {
+	if err := verifyPins(cs, p.pins, name); err != nil {
+		return err
+	}
+	if p.roots == nil {
+		return nil
+	}
+	if name == "" {
+		return errUnknownUpstreamName
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       name,
+		Roots:         p.roots,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// dialTLS returns the DialTLSContext of tr. The certificates are verified
+// for the server name of the config or else the dialed host.
+func (p *pinVerifier) dialTLS(tr *http.Transport) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := tr.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		// tr.TLSClientConfig has the ALPN protocols set by the transport
+		cfg := tr.TLSClientConfig.Clone()
+		if cfg.ServerName == "" {
+			cfg.ServerName = host
+		}
+		name := cfg.ServerName
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			return p.verify(cs, name)
+		}
+		if tr.TLSHandshakeTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, tr.TLSHandshakeTimeout)
+			defer cancel()
+		}
+		tc := tls.Client(conn, cfg)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tc, nil
+	}
+}
+
+// verifyPins accepts a pinned leaf, or a leaf issued for name by a pinned
+// certificate of the peer chain. The pinned certificates are the only
+// roots, so a forged leaf followed by a pinned CA is rejected.
+func verifyPins(cs tls.ConnectionState, pins [][]byte, name string) error {
+	certs := cs.PeerCertificates
+	if len(certs) < 1 {
+		return fmt.Errorf("upstream sent no certificate")
+	}
+	if matchPin(certs[0], pins) {
+		return nil
+	}
+	roots := x509.NewCertPool()
+	intermediates := x509.NewCertPool()
+	pinned := false
+	for _, cert := range certs[1:] {
+		if matchPin(cert, pins) {
+			roots.AddCert(cert)
+			pinned = true
+		} else {
+			intermediates.AddCert(cert)
+		}
+	}
+	if !pinned {
+		return fmt.Errorf("upstream certificate does not match the pinned fingerprints")
+	}
+	if name == "" {
+		// an empty name would skip the host name check
+		return errUnknownUpstreamName
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       name,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		return fmt.Errorf("upstream certificate is not issued by a pinned certificate: %v", err)
+	}
+	return nil
+}
+
+func matchPin(cert *x509.Certificate, pins [][]byte) bool {
+	sum := sha256.Sum256(cert.Raw)
+	for _, pin := range pins {
+		if bytes.Equal(sum[:], pin) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,156 @@
+package route
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUpstreamTLS(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	cert := upstream.Certificate()
+	sum := sha256.Sum256(cert.Raw)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		cfg  UpstreamTLSConfig
+		ok   bool
+	}{
+		{"system roots", UpstreamTLSConfig{}, false},
+		{"ca file", UpstreamTLSConfig{CAFile: caFile, ServerName: "example.com"}, true},
+		{"ca file wrong name", UpstreamTLSConfig{CAFile: caFile, ServerName: "example.org"}, false},
+		{"pin", UpstreamTLSConfig{Pins: []string{hex.EncodeToString(sum[:])}}, true},
+		{"wrong pin", UpstreamTLSConfig{Pins: []string{hex.EncodeToString(make([]byte, 32))}}, false},
+	}
+	for _, c := range cases {
+		tlsConfig, err := c.cfg.TLSConfig()
+		if err != nil {
+			t.Fatalf("(%v) %v", c.name, err)
+		}
+		cl := &http.Client{Transport: TransportConfig{}.NewTransport(tlsConfig)}
+		resp, err := cl.Get(upstream.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if (err == nil) != c.ok {
+			t.Fatalf("(%v) ok should be %v; err: %v", c.name, c.ok, err)
+		}
+	}
+}
+
+func testIssue(t *testing.T, tpl *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tpl.NotBefore = time.Now().Add(-time.Hour)
+	tpl.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = tpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestUpstreamTLSPinnedIntermediate(t *testing.T) {
+	caTpl := func(name string) *x509.Certificate {
+		return &x509.Certificate{
+			Subject:               pkix.Name{CommonName: name},
+			KeyUsage:              x509.KeyUsageCertSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+	}
+	leafTpl := func() *x509.Certificate {
+		return &x509.Certificate{
+			Subject:     pkix.Name{CommonName: "upstream"},
+			IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+	}
+	otherTpl := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "other.example.com"},
+		DNSNames:    []string{"other.example.com"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	root, rootKey := testIssue(t, caTpl("root"), nil, nil)
+	inter, interKey := testIssue(t, caTpl("intermediate"), root, rootKey)
+	leaf, leafKey := testIssue(t, leafTpl(), inter, interKey)
+	// the attacker's leaf is self-signed, the pinned intermediate is public
+	forged, forgedKey := testIssue(t, leafTpl(), nil, nil)
+	// a valid certificate of the pinned intermediate, for another name
+	other, otherKey := testIssue(t, otherTpl, inter, interKey)
+
+	serve := func(chain []*x509.Certificate, key *ecdsa.PrivateKey) *httptest.Server {
+		cert := tls.Certificate{PrivateKey: key}
+		for _, c := range chain {
+			cert.Certificate = append(cert.Certificate, c.Raw)
+		}
+		s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}))
+		s.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+		s.StartTLS()
+		return s
+	}
+	sum := sha256.Sum256(inter.Raw)
+	cfg := UpstreamTLSConfig{Pins: []string{hex.EncodeToString(sum[:])}}
+
+	cases := []struct {
+		name string
+		srv  *httptest.Server
+		ok   bool
+	}{
+		{"issued by the pinned intermediate", serve([]*x509.Certificate{leaf, inter}, leafKey), true},
+		{"forged leaf with the pinned intermediate", serve([]*x509.Certificate{forged, inter}, forgedKey), false},
+		{"ip upstream with a certificate for another name", serve([]*x509.Certificate{other, inter}, otherKey), false},
+	}
+	for _, c := range cases {
+		defer c.srv.Close()
+		// the upstream is an IP address, so no SNI is sent
+		rt := &Route{
+			Server:      RouteServer{OutConnType: HTTPS_VERIFY},
+			UpstreamTLS: &cfg,
+		}
+		if err := rt.SetupTransport(TransportConfig{}); err != nil {
+			t.Fatal(err)
+		}
+		cl := &http.Client{Transport: buildTransport(rt)}
+		resp, err := cl.Get(c.srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if (err == nil) != c.ok {
+			t.Fatalf("(%v) ok should be %v; err: %v", c.name, c.ok, err)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package accesslog
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Formats
+const (
+	FormatJSON     = "json"
+	FormatCommon   = "common"
+	FormatCombined = "combined"
+)
+
+// Config configures the access log.
+type Config struct {
+	// Enabled logs every route by default (routes can override it)
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Format: "json" (default), "common" or "combined"
+	Format string `json:"format,omitempty" yaml:"format"`
+	// Output: "stdout" (default), "stderr" or a file path
+	Output string `json:"output,omitempty" yaml:"output"`
+	// MaxSizeMB rotates the output file when it grows past this size
+	MaxSizeMB int `json:"max_size_mb,omitempty" yaml:"max_size_mb"`
+	// MaxBackups is the amount of rotated files to keep (default 5)
+	MaxBackups int `json:"max_backups,omitempty" yaml:"max_backups"`
+	// Sample is the fraction of requests to log (0 or 1 = all)
+	Sample float64 `json:"sample,omitempty" yaml:"sample"`
+}
+
+// Entry is an access log line. ClientIP is the client address resolved
+// through the trusted proxies and RemoteAddr is the TCP peer.
+type Entry struct {
+	Time            time.Time `json:"time"`
+	RequestID       string    `json:"request_id,omitempty"`
+	ClientIP        string    `json:"client_ip,omitempty"`
+	RemoteAddr      string    `json:"remote_addr"`
+	Host            string    `json:"host"`
+	Method          string    `json:"method"`
+	URI             string    `json:"uri"`
+	Proto           string    `json:"proto"`
+	Route           string    `json:"route,omitempty"`
+	Upstream        string    `json:"upstream,omitempty"`
+	Status          int       `json:"status"`
+	Bytes           int64     `json:"bytes"`
+	Duration        float64   `json:"duration_ms"`
+	UpstreamLatency float64   `json:"upstream_latency_ms,omitempty"`
+	UpstreamError   string    `json:"upstream_error,omitempty"`
+	TLSVersion      string    `json:"tls_version,omitempty"`
+	Referer         string    `json:"referer,omitempty"`
+	UserAgent       string    `json:"user_agent,omitempty"`
+}
+
+// Logger writes access log entries.
+type Logger struct {
+	cfg Config
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// New creates a logger and opens its output.
+func New(cfg Config) (*Logger, error) {
+	l := &Logger{
+		cfg: cfg,
+	}
+	switch cfg.Output {
+	case "", "stdout":
+		l.out = os.Stdout
+	case "stderr":
+		l.out = os.Stderr
+	default:
+		f, err := newRotateFile(cfg.Output, int64(cfg.MaxSizeMB)*1024*1024, cfg.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		l.out = f
+	}
+	return l, nil
+}
+
+// Enabled reports whether requests of routes without an explicit setting
+// are logged.
+func (l *Logger) Enabled() bool {
+	return l != nil && l.cfg.Enabled
+}
+
+// Sampled reports whether the current request should be logged.
+func (l *Logger) Sampled() bool {
+	if l.cfg.Sample <= 0 || l.cfg.Sample >= 1 {
+		return true
+	}
+	return rand.Float64() < l.cfg.Sample
+}
+
+// Log writes e.
+func (l *Logger) Log(e *Entry) {
+	var line []byte
+	switch l.cfg.Format {
+	case FormatCommon:
+		line = []byte(e.common() + "\n")
+	case FormatCombined:
+		line = []byte(e.common() + " " + strconv.Quote(e.Referer) + " " + strconv.Quote(e.UserAgent) + "\n")
+	default:
+		var err error
+		if line, err = json.Marshal(e); err != nil {
+			return
+		}
+		line = append(line, '\n')
+	}
+	l.mu.Lock()
+	l.out.Write(line)
+	l.mu.Unlock()
+}
+
+// Close closes the output file (if any).
+func (l *Logger) Close() error {
+	if c, ok := l.out.(io.Closer); ok && l.out != os.Stdout && l.out != os.Stderr {
+		return c.Close()
+	}
+	return nil
+}
+
+func (e *Entry) common() string {
+	host := e.ClientIP
+	if host == "" {
+		host = e.RemoteAddr
+		if i := strings.LastIndex(host, ":"); i > 0 && !strings.HasSuffix(host, "]") {
+			host = host[:i]
+		}
+	}
+	return fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %d",
+		host, e.Time.Format("02/Jan/2006:15:04:05 -0700"), e.Method, e.URI, e.Proto, e.Status, e.Bytes)
+}
+
+// TLSVersionName returns the name of a tls.Version* constant
+func TLSVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLS1.0"
+	case tls.VersionTLS11:
+		return "TLS1.1"
+	case tls.VersionTLS12:
+		return "TLS1.2"
+	case tls.VersionTLS13:
+		return "TLS1.3"
+	}
+	return ""
+}
@@ -0,0 +1,84 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testEntry() *Entry {
+	return &Entry{
+		Time:       time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		RemoteAddr: "10.0.0.1:5555",
+		Host:       "example.com",
+		Method:     "GET",
+		URI:        "/a?b=c",
+		Proto:      "HTTP/1.1",
+		Route:      "example.com",
+		Status:     200,
+		Bytes:      42,
+		UserAgent:  "curl",
+	}
+}
+
+func TestFormats(t *testing.T) {
+	dir := t.TempDir()
+	for _, format := range []string{FormatJSON, FormatCommon, FormatCombined} {
+		path := filepath.Join(dir, format+".log")
+		l, err := New(Config{Format: format, Output: path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Log(testEntry())
+		l.Close()
+		bs, _ := os.ReadFile(path)
+		line := string(bs)
+		switch format {
+		case FormatJSON:
+			e := &Entry{}
+			if err := json.Unmarshal(bs, e); err != nil {
+				t.Fatal(err)
+			}
+			if e.Route != "example.com" || e.Status != 200 {
+				t.Fatalf("invalid json entry %v", line)
+			}
+		case FormatCommon:
+			want := `10.0.0.1 - - [02/Jan/2020:03:04:05 +0000] "GET /a?b=c HTTP/1.1" 200 42` + "\n"
+			if line != want {
+				t.Fatalf("common line should be %q but it is %q", want, line)
+			}
+			e := testEntry()
+			e.ClientIP = "203.0.113.7"
+			if v := e.common(); !strings.HasPrefix(v, "203.0.113.7 - - ") {
+				t.Fatalf("common line should start with the client ip, got %q", v)
+			}
+		case FormatCombined:
+			if !strings.HasSuffix(line, ` "" "curl"`+"\n") {
+				t.Fatalf("invalid combined line %q", line)
+			}
+		}
+	}
+}
+
+func TestRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := newRotateFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		f.Write([]byte("12345678\n"))
+	}
+	f.Close()
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		if _, err := os.Stat(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Fatal("only 2 backups should be kept")
+	}
+}
@@ -0,0 +1,208 @@
+package acmedns
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestChallengeFQDN(t *testing.T) {
+	for in, want := range map[string]string{
+		"example.com":    "_acme-challenge.example.com.",
+		"*.example.com":  "_acme-challenge.example.com.",
+		"a.example.com.": "_acme-challenge.a.example.com.",
+	} {
+		if got := ChallengeFQDN(in); got != want {
+			t.Errorf("ChallengeFQDN(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+// testZone is a tiny authoritative server that accepts dynamic updates
+type testZone struct {
+	mu      sync.Mutex
+	records map[string]string
+}
+
+func (z *testZone) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	switch req.Opcode {
+	case dns.OpcodeUpdate:
+		if req.IsTsig() == nil || w.TsigStatus() != nil {
+			m.Rcode = dns.RcodeRefused
+			break
+		}
+		z.mu.Lock()
+		for _, rr := range req.Ns {
+			txt, ok := rr.(*dns.TXT)
+			if !ok {
+				continue
+			}
+			if txt.Hdr.Class == dns.ClassNONE {
+				delete(z.records, txt.Hdr.Name)
+			} else {
+				z.records[txt.Hdr.Name] = strings.Join(txt.Txt, "")
+			}
+		}
+		z.mu.Unlock()
+	default:
+		q := req.Question[0]
+		if q.Qtype == dns.TypeSOA && q.Name == "example.com." {
+			m.Answer = append(m.Answer, &dns.SOA{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+				Ns:  "ns.example.com.", Mbox: "admin.example.com.",
+			})
+		}
+		z.mu.Lock()
+		if v, ok := z.records[q.Name]; ok && q.Qtype == dns.TypeTXT {
+			m.Answer = append(m.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+				Txt: []string{v},
+			})
+		}
+		z.mu.Unlock()
+	}
+	w.WriteMsg(m)
+}
+
+func TestRFC2136(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zone := &testZone{records: make(map[string]string)}
+	srv := &dns.Server{
+		PacketConn: pc,
+		Handler:    zone,
+		MsgAcceptFunc: func(dh dns.Header) dns.MsgAcceptAction {
+			return dns.MsgAccept
+		},
+		TsigSecret: map[string]string{"sandpiper.": "c2VjcmV0c2VjcmV0c2VjcmV0"},
+	}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	ctx := context.Background()
+	fqdn := ChallengeFQDN("*.example.com")
+	p := &RFC2136{
+		Nameserver: pc.LocalAddr().String(),
+		TSIGKey:    "sandpiper",
+		TSIGSecret: "c2VjcmV0c2VjcmV0c2VjcmV0",
+	}
+	if err := p.Present(ctx, fqdn, "token-value"); err != nil {
+		t.Fatal(err)
+	}
+	if !hasTXT(ctx, p.Nameserver, fqdn, "token-value") {
+		t.Error("record not present")
+	}
+	if err := p.CleanUp(ctx, fqdn, "token-value"); err != nil {
+		t.Fatal(err)
+	}
+	if hasTXT(ctx, p.Nameserver, fqdn, "token-value") {
+		t.Error("record not removed")
+	}
+
+	bad := *p
+	bad.TSIGSecret = "d3JvbmdzZWNyZXQ="
+	if err := bad.Present(ctx, fqdn, "token-value"); err == nil {
+		t.Error("expected an error with a wrong tsig secret")
+	}
+}
+
+func TestExec(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	script := filepath.Join(dir, "hook.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\necho \"$1 $2 $3 $ZONE\" >> "+out+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewProvider(Config{Provider: ProviderExec, Exec: &Exec{
+		Command: script,
+		Env:     map[string]string{"ZONE": "example.com"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := p.Present(ctx, "_acme-challenge.example.com.", "abc"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.CleanUp(ctx, "_acme-challenge.example.com.", "abc"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "present _acme-challenge.example.com. abc example.com\ncleanup _acme-challenge.example.com. abc example.com\n"
+	if string(data) != want {
+		t.Errorf("hook calls = %q, want %q", data, want)
+	}
+
+	fail := &Exec{Command: "false"}
+	if err := fail.Present(ctx, "x.", "y"); err == nil {
+		t.Error("expected an error from a failing command")
+	}
+}
+
+// TestPebble obtains a wildcard certificate from a pebble server
+// (PEBBLE_DIRECTORY) using the exec provider command in PEBBLE_DNS_HOOK.
+func TestPebble(t *testing.T) {
+	dir, hook := os.Getenv("PEBBLE_DIRECTORY"), os.Getenv("PEBBLE_DNS_HOOK")
+	if dir == "" || hook == "" {
+		t.Skip("PEBBLE_DIRECTORY and PEBBLE_DNS_HOOK are not set")
+	}
+	m, err := NewManager(Config{
+		DirectoryURL:    dir,
+		Provider:        ProviderExec,
+		Exec:            &Exec{Command: hook},
+		PropagationWait: -1,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := m.Obtain(context.Background(), "*.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := cert.Leaf.DNSNames; len(names) != 1 || names[0] != "*.example.com" {
+		t.Errorf("DNSNames = %v", names)
+	}
+}
+
+func TestRunRetry(t *testing.T) {
+	m, err := NewManager(Config{Provider: ProviderExec, Exec: &Exec{Command: "true"}, DirectoryURL: "http://127.0.0.1:1/directory"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.retryMin = time.Millisecond * 10
+	var mu sync.Mutex
+	failures := 0
+	m.OnError = func(domain string, err error) {
+		mu.Lock()
+		failures++
+		mu.Unlock()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	m.Run(ctx, []string{"example.com"}, func(string, *tls.Certificate) {})
+	mu.Lock()
+	defer mu.Unlock()
+	// 10ms, 20ms, 40ms, 80ms
+	if failures < 3 {
+		t.Fatalf("failed domains should be retried before the next check, got %v attempts", failures)
+	}
+	if d := m.retryDelay(100); d != time.Hour {
+		t.Fatalf("the retry delay should be capped at 1 hour, got %v", d)
+	}
+}
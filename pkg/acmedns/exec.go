@@ -0,0 +1,43 @@
+package acmedns
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Exec runs a command to create and remove the challenge records:
+//
+//	<command> present <fqdn> <value>
+//	<command> cleanup <fqdn> <value>
+type Exec struct {
+	Command string `json:"command" yaml:"command"`
+	// Env is added to the command environment
+	Env map[string]string `json:"env,omitempty" yaml:"env"`
+}
+
+// Present runs "<command> present <fqdn> <value>".
+func (p *Exec) Present(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, "present", fqdn, value)
+}
+
+// CleanUp runs "<command> cleanup <fqdn> <value>".
+func (p *Exec) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, "cleanup", fqdn, value)
+}
+
+func (p *Exec) run(ctx context.Context, action, fqdn, value string) error {
+	cmd := exec.CommandContext(ctx, p.Command, action, fqdn, value)
+	cmd.Env = os.Environ()
+	for k, v := range p.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "exec %v %v: %s", p.Command, action, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
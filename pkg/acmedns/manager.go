@@ -0,0 +1,424 @@
+package acmedns
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gabstv/sandpiper/pkg/logging"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Config of the DNS-01 certificate manager.
+type Config struct {
+	Email string `json:"email,omitempty" yaml:"email"`
+	// DirectoryURL defaults to Let's Encrypt
+	DirectoryURL string `json:"directory_url,omitempty" yaml:"directory_url"`
+	// Provider is "rfc2136" or "exec"
+	Provider string   `json:"provider" yaml:"provider"`
+	RFC2136  *RFC2136 `json:"rfc2136,omitempty" yaml:"rfc2136"`
+	Exec     *Exec    `json:"exec,omitempty" yaml:"exec"`
+	// PropagationWait (seconds) to wait after the record is created
+	// when no Nameservers are set (default 30, negative = no wait)
+	PropagationWait int `json:"propagation_wait,omitempty" yaml:"propagation_wait"`
+	// Nameservers (host:port) are polled until they serve the record
+	Nameservers []string `json:"nameservers,omitempty" yaml:"nameservers"`
+	// PropagationTimeout (seconds) limits the polling of Nameservers
+	// (default 120)
+	PropagationTimeout int `json:"propagation_timeout,omitempty" yaml:"propagation_timeout"`
+	// RenewBefore is how many days before expiry certificates are
+	// renewed (default 30)
+	RenewBefore int `json:"renew_before,omitempty" yaml:"renew_before"`
+}
+
+const accountKeyName = "acme-dns+account"
+
+// Manager obtains and renews certificates with DNS-01 challenges.
+type Manager struct {
+	Cfg      Config
+	Provider Provider
+	// Cache stores the account key and the certificates (optional)
+	Cache  autocert.Cache
+	Logger *slog.Logger
+	// OnError (optional) is called when Run fails to obtain a certificate
+	OnError func(domain string, err error)
+
+	mu     sync.Mutex
+	client *acme.Client
+	// retryMin is the first retry delay of Run (default 1 minute)
+	retryMin time.Duration
+}
+
+// NewManager creates a Manager with the provider of cfg.
+func NewManager(cfg Config, cache autocert.Cache) (*Manager, error) {
+	p, err := NewProvider(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Manager{
+		Cfg:      cfg,
+		Provider: p,
+		Cache:    cache,
+		Logger:   logging.Discard(),
+	}, nil
+}
+
+// Certificate returns the cached certificate of domain, or obtains a
+// new one if it is missing or due for renewal.
+func (m *Manager) Certificate(ctx context.Context, domain string) (*tls.Certificate, error) {
+	if cert, err := m.cached(ctx, domain); err == nil && !m.needsRenewal(cert) {
+		return cert, nil
+	}
+	return m.Obtain(ctx, domain)
+}
+
+// Run keeps the certificates of domains valid, calling set each time one
+// is loaded or renewed, until ctx is done. Domains that fail are retried
+// with a backoff (1 minute, doubling up to 1 hour) until they succeed.
+func (m *Manager) Run(ctx context.Context, domains []string, set func(domain string, cert *tls.Certificate)) {
+	failures := make(map[string]int)
+	retryAt := make(map[string]time.Time)
+	check := func(domains []string) {
+		for _, d := range domains {
+			cert, err := m.Certificate(ctx, d)
+			if err != nil {
+				m.Logger.Error("acme dns-01 certificate", "domain", d, "err", err)
+				if m.OnError != nil {
+					m.OnError(d, err)
+				}
+				failures[d]++
+				retryAt[d] = time.Now().Add(m.retryDelay(failures[d]))
+				continue
+			}
+			delete(failures, d)
+			delete(retryAt, d)
+			set(d, cert)
+		}
+	}
+	check(domains)
+	t := time.NewTicker(time.Hour * 12)
+	defer t.Stop()
+	for {
+		var retry *time.Timer
+		var retryC <-chan time.Time
+		if len(retryAt) > 0 {
+			next := time.Time{}
+			for _, at := range retryAt {
+				if next.IsZero() || at.Before(next) {
+					next = at
+				}
+			}
+			retry = time.NewTimer(time.Until(next))
+			retryC = retry.C
+		}
+		var due []string
+		select {
+		case <-ctx.Done():
+		case <-t.C:
+			due = domains
+		case <-retryC:
+			for _, d := range domains {
+				if at, ok := retryAt[d]; ok && !at.After(time.Now()) {
+					due = append(due, d)
+				}
+			}
+		}
+		if retry != nil {
+			retry.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		check(due)
+	}
+}
+
+// retryDelay is the backoff after n consecutive failures of a domain
+func (m *Manager) retryDelay(n int) time.Duration {
+	d := m.retryMin
+	if d <= 0 {
+		d = time.Minute
+	}
+	for i := 1; i < n && d < time.Hour; i++ {
+		d *= 2
+	}
+	if d > time.Hour {
+		d = time.Hour
+	}
+	return d
+}
+
+// Obtain requests a new certificate of domain (which may be a wildcard).
+func (m *Manager) Obtain(ctx context.Context, domain string) (*tls.Certificate, error) {
+	client, err := m.acmeClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(domain))
+	if err != nil {
+		return nil, errors.Wrap(err, "authorize order")
+	}
+	for _, u := range order.AuthzURLs {
+		if err := m.authorize(ctx, client, u); err != nil {
+			return nil, err
+		}
+	}
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, errors.Wrap(err, "wait order")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domain},
+		DNSNames: []string{domain},
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "create certificate")
+	}
+	cert, err := tlsCert(der, key)
+	if err != nil {
+		return nil, err
+	}
+	m.Logger.Info("acme dns-01 certificate obtained", "domain", domain, "not_after", cert.Leaf.NotAfter)
+	if m.Cache != nil {
+		if err := m.Cache.Put(ctx, certKey(domain), encodeCert(der, key)); err != nil {
+			m.Logger.Warn("acme dns-01 cache", "domain", domain, "err", err)
+		}
+	}
+	return cert, nil
+}
+
+// Revoke revokes cert (the certificate of domain) and removes it from
+// the cache.
+func (m *Manager) Revoke(ctx context.Context, domain string, cert *tls.Certificate) error {
+	client, err := m.acmeClient(ctx)
+	if err != nil {
+		return err
+	}
+	if err := client.RevokeCert(ctx, nil, cert.Certificate[0], acme.CRLReasonUnspecified); err != nil {
+		return errors.Wrap(err, "revoke certificate")
+	}
+	return m.Delete(ctx, domain)
+}
+
+// Delete removes the cached certificate of domain.
+func (m *Manager) Delete(ctx context.Context, domain string) error {
+	if m.Cache == nil {
+		return nil
+	}
+	return m.Cache.Delete(ctx, certKey(domain))
+}
+
+// authorize fulfills the dns-01 challenge of a pending authorization
+func (m *Manager) authorize(ctx context.Context, client *acme.Client, url string) error {
+	authz, err := client.GetAuthorization(ctx, url)
+	if err != nil {
+		return errors.Wrap(err, "get authorization")
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "dns-01" {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return errors.Errorf("no dns-01 challenge for %v", authz.Identifier.Value)
+	}
+	value, err := client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
+	fqdn := ChallengeFQDN(authz.Identifier.Value)
+	if err := m.Provider.Present(ctx, fqdn, value); err != nil {
+		return errors.Wrap(err, "present dns record")
+	}
+	defer func() {
+		if err := m.Provider.CleanUp(context.Background(), fqdn, value); err != nil {
+			m.Logger.Warn("acme dns-01 cleanup", "fqdn", fqdn, "err", err)
+		}
+	}()
+	if err := m.waitPropagation(ctx, fqdn, value); err != nil {
+		return err
+	}
+	if _, err := client.Accept(ctx, chal); err != nil {
+		return errors.Wrap(err, "accept challenge")
+	}
+	if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return errors.Wrap(err, "wait authorization")
+	}
+	return nil
+}
+
+// waitPropagation polls the configured nameservers until all of them
+// serve the record, or just waits PropagationWait
+func (m *Manager) waitPropagation(ctx context.Context, fqdn, value string) error {
+	if len(m.Cfg.Nameservers) == 0 {
+		wait := time.Duration(m.Cfg.PropagationWait) * time.Second
+		if m.Cfg.PropagationWait == 0 {
+			wait = time.Second * 30
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+			return nil
+		}
+	}
+	timeout := time.Duration(m.Cfg.PropagationTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = time.Minute * 2
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for _, ns := range m.Cfg.Nameservers {
+		for !hasTXT(ctx, ns, fqdn, value) {
+			select {
+			case <-ctx.Done():
+				return errors.Errorf("dns record %v not found at %v", fqdn, ns)
+			case <-time.After(time.Second * 2):
+			}
+		}
+	}
+	return nil
+}
+
+func hasTXT(ctx context.Context, ns, fqdn, value string) bool {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(fqdn), dns.TypeTXT)
+	r, _, err := new(dns.Client).ExchangeContext(ctx, msg, ns)
+	if err != nil {
+		return false
+	}
+	for _, rr := range r.Answer {
+		if txt, ok := rr.(*dns.TXT); ok && strings.Join(txt.Txt, "") == value {
+			return true
+		}
+	}
+	return false
+}
+
+// acmeClient returns the registered ACME client
+func (m *Manager) acmeClient(ctx context.Context) (*acme.Client, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.client != nil {
+		return m.client, nil
+	}
+	key, err := m.accountKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	client := &acme.Client{Key: key, DirectoryURL: m.Cfg.DirectoryURL}
+	acct := &acme.Account{}
+	if m.Cfg.Email != "" {
+		acct.Contact = []string{"mailto:" + m.Cfg.Email}
+	}
+	if _, err := client.Register(ctx, acct, acme.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
+		return nil, errors.Wrap(err, "acme register")
+	}
+	m.client = client
+	return client, nil
+}
+
+func (m *Manager) accountKey(ctx context.Context) (crypto.Signer, error) {
+	if m.Cache != nil {
+		if data, err := m.Cache.Get(ctx, accountKeyName); err == nil {
+			if b, _ := pem.Decode(data); b != nil {
+				if key, err := x509.ParseECPrivateKey(b.Bytes); err == nil {
+					return key, nil
+				}
+			}
+		}
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if m.Cache != nil {
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+		if err := m.Cache.Put(ctx, accountKeyName, data); err != nil {
+			return nil, errors.Wrap(err, "cache account key")
+		}
+	}
+	return key, nil
+}
+
+func (m *Manager) cached(ctx context.Context, domain string) (*tls.Certificate, error) {
+	if m.Cache == nil {
+		return nil, autocert.ErrCacheMiss
+	}
+	data, err := m.Cache.Get(ctx, certKey(domain))
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+func (m *Manager) needsRenewal(cert *tls.Certificate) bool {
+	before := time.Duration(m.Cfg.RenewBefore) * time.Hour * 24
+	if before <= 0 {
+		before = time.Hour * 24 * 30
+	}
+	return time.Now().Add(before).After(cert.Leaf.NotAfter)
+}
+
+// certKey is the cache key of the certificate of domain
+func certKey(domain string) string {
+	return strings.Replace(domain, "*", "_wildcard", 1) + "+dns01"
+}
+
+func encodeCert(der [][]byte, key *ecdsa.PrivateKey) []byte {
+	var buf bytes.Buffer
+	kb, _ := x509.MarshalECPrivateKey(key)
+	pem.Encode(&buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: kb})
+	for _, b := range der {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: b})
+	}
+	return buf.Bytes()
+}
+
+func tlsCert(der [][]byte, key crypto.Signer) (*tls.Certificate, error) {
+	if len(der) == 0 {
+		return nil, errors.New("empty certificate chain")
+	}
+	leaf, err := x509.ParseCertificate(der[0])
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: der, PrivateKey: key, Leaf: leaf}, nil
+}
@@ -0,0 +1,48 @@
+package acmedns
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Provider creates and removes the TXT records of the DNS-01 challenges.
+type Provider interface {
+	// Present creates the TXT record fqdn with value
+	Present(ctx context.Context, fqdn, value string) error
+	// CleanUp removes the TXT record created by Present
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+// Provider names
+const (
+	ProviderRFC2136 = "rfc2136"
+	ProviderExec    = "exec"
+)
+
+// ChallengeFQDN returns the name of the challenge record of domain
+// (wildcards use the record of the base domain).
+func ChallengeFQDN(domain string) string {
+	domain = strings.TrimPrefix(strings.TrimSuffix(domain, "."), "*.")
+	return "_acme-challenge." + domain + "."
+}
+
+// NewProvider creates the provider selected by cfg.Provider.
+func NewProvider(cfg Config) (Provider, error) {
+	switch cfg.Provider {
+	case ProviderRFC2136:
+		if cfg.RFC2136 == nil {
+			return nil, errors.New("rfc2136 provider is not configured")
+		}
+		p := *cfg.RFC2136
+		return &p, nil
+	case ProviderExec:
+		if cfg.Exec == nil {
+			return nil, errors.New("exec provider is not configured")
+		}
+		p := *cfg.Exec
+		return &p, nil
+	}
+	return nil, errors.Errorf("unknown dns provider %q", cfg.Provider)
+}
@@ -0,0 +1,114 @@
+package acmedns
+
+import (
+	"context"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// RFC2136 updates the challenge records with dynamic DNS updates.
+type RFC2136 struct {
+	// Nameserver is the primary server of the zone (host:port)
+	Nameserver string `json:"nameserver" yaml:"nameserver"`
+	// Zone (e.g. example.com.) is found with a SOA query if empty
+	Zone string `json:"zone,omitempty" yaml:"zone"`
+	// TSIG credentials (optional)
+	TSIGKey    string `json:"tsig_key,omitempty" yaml:"tsig_key"`
+	TSIGSecret string `json:"tsig_secret,omitempty" yaml:"tsig_secret"`
+	// TSIGAlgorithm defaults to hmac-sha256.
+	TSIGAlgorithm string `json:"tsig_algorithm,omitempty" yaml:"tsig_algorithm"`
+	// TTL of the records (default 60)
+	TTL int `json:"ttl,omitempty" yaml:"ttl"`
+	// Timeout (seconds) of each request (default 10)
+	Timeout int `json:"timeout,omitempty" yaml:"timeout"`
+}
+
+// Present adds the TXT record.
+func (p *RFC2136) Present(ctx context.Context, fqdn, value string) error {
+	return p.update(ctx, fqdn, value, true)
+}
+
+// CleanUp removes the TXT record.
+func (p *RFC2136) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.update(ctx, fqdn, value, false)
+}
+
+func (p *RFC2136) update(ctx context.Context, fqdn, value string, add bool) error {
+	zone := p.Zone
+	if zone == "" {
+		var err error
+		if zone, err = p.findZone(ctx, fqdn); err != nil {
+			return err
+		}
+	}
+	ttl := p.TTL
+	if ttl <= 0 {
+		ttl = 60
+	}
+	rr := &dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   dns.Fqdn(fqdn),
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassINET,
+			Ttl:    uint32(ttl),
+		},
+		Txt: []string{value},
+	}
+	m := new(dns.Msg)
+	m.SetUpdate(dns.Fqdn(zone))
+	if add {
+		m.Insert([]dns.RR{rr})
+	} else {
+		m.Remove([]dns.RR{rr})
+	}
+	c := p.client()
+	if p.TSIGKey != "" {
+		alg := p.TSIGAlgorithm
+		if alg == "" {
+			alg = dns.HmacSHA256
+		}
+		m.SetTsig(dns.Fqdn(p.TSIGKey), dns.Fqdn(alg), 300, time.Now().Unix())
+		c.TsigSecret = map[string]string{dns.Fqdn(p.TSIGKey): p.TSIGSecret}
+	}
+	r, _, err := c.ExchangeContext(ctx, m, p.Nameserver)
+	if err != nil {
+		return errors.Wrap(err, "rfc2136 update")
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return errors.Errorf("rfc2136 update: %v", dns.RcodeToString[r.Rcode])
+	}
+	return nil
+}
+
+// findZone asks the nameserver for the SOA of fqdn
+func (p *RFC2136) findZone(ctx context.Context, fqdn string) (string, error) {
+	name := dns.Fqdn(fqdn)
+	for {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeSOA)
+		r, _, err := p.client().ExchangeContext(ctx, m, p.Nameserver)
+		if err != nil {
+			return "", errors.Wrap(err, "rfc2136 zone lookup")
+		}
+		for _, rr := range append(r.Answer, r.Ns...) {
+			if soa, ok := rr.(*dns.SOA); ok {
+				return soa.Hdr.Name, nil
+			}
+		}
+		i, end := dns.NextLabel(name, 0)
+		if end {
+			return "", errors.Errorf("rfc2136: zone of %v not found", fqdn)
+		}
+		name = name[i:]
+	}
+}
+
+func (p *RFC2136) client() *dns.Client {
+	timeout := time.Duration(p.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = time.Second * 10
+	}
+	return &dns.Client{Net: "udp", Timeout: timeout}
+}
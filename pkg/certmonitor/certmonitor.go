@@ -0,0 +1,255 @@
+// Package certmonitor warns about certificates that are about to expire
+// or that failed to renew.
+package certmonitor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gabstv/sandpiper/pkg/logging"
+	"github.com/pkg/errors"
+)
+
+// Config of the monitor.
+type Config struct {
+	// Interval (seconds) between checks (default 3600)
+	Interval int `json:"interval,omitempty" yaml:"interval"`
+	// Window (days) before NotAfter that a certificate is reported as
+	// expiring (default 21)
+	Window int `json:"window,omitempty" yaml:"window"`
+	// Webhook (optional) receives a POST with the json Alert when an
+	// alert is raised or resolved
+	Webhook string `json:"webhook,omitempty" yaml:"webhook"`
+	// WebhookHeaders are added to the webhook requests
+	WebhookHeaders map[string]string `json:"webhook_headers,omitempty" yaml:"webhook_headers"`
+	// WebhookTimeout (seconds) of each webhook request (default 10)
+	WebhookTimeout int `json:"webhook_timeout,omitempty" yaml:"webhook_timeout"`
+}
+
+// Certificate is a certificate checked by the monitor.
+type Certificate struct {
+	ID       string
+	Source   string
+	DNSNames []string
+	NotAfter time.Time
+}
+
+// Alert kinds
+const (
+	KindExpiring      = "expiring"
+	KindExpired       = "expired"
+	KindRenewalFailed = "renewal_failed"
+)
+
+// Alert is an open (or, in webhooks, resolved) certificate problem.
+type Alert struct {
+	Kind     string    `json:"kind"`
+	ID       string    `json:"id"`
+	Source   string    `json:"source,omitempty"`
+	DNSNames []string  `json:"dns_names,omitempty"`
+	NotAfter time.Time `json:"not_after,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Since    time.Time `json:"since"`
+	// Resolved is only set in webhooks
+	Resolved bool `json:"resolved,omitempty"`
+}
+
+// Monitor checks the certificates returned by List.
+type Monitor struct {
+	Cfg  Config
+	List func() []Certificate
+	// Logger receives the alerts at warning level
+	Logger *slog.Logger
+	// Client sends the webhooks (default: http.Client with WebhookTimeout)
+	Client *http.Client
+
+	mu     sync.Mutex
+	alerts map[string]Alert
+}
+
+// New creates a monitor of the certificates returned by list.
+func New(cfg Config, list func() []Certificate) *Monitor {
+	timeout := time.Duration(cfg.WebhookTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = time.Second * 10
+	}
+	return &Monitor{
+		Cfg:    cfg,
+		List:   list,
+		Logger: logging.Discard(),
+		Client: &http.Client{Timeout: timeout},
+		alerts: make(map[string]Alert),
+	}
+}
+
+// Run checks the certificates every interval until ctx is done.
+func (m *Monitor) Run(ctx context.Context) {
+	interval := time.Duration(m.Cfg.Interval) * time.Second
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	m.Check(time.Now())
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			m.Check(now)
+		}
+	}
+}
+
+// Check raises the alerts of the certificates that expire within the
+// window and resolves the ones that were replaced.
+func (m *Monitor) Check(now time.Time) {
+	window := time.Duration(m.Cfg.Window) * time.Hour * 24
+	if window <= 0 {
+		window = time.Hour * 24 * 21
+	}
+	seen := make(map[string]bool)
+	for _, c := range m.List() {
+		kind := ""
+		if !now.Before(c.NotAfter) {
+			kind = KindExpired
+		} else if c.NotAfter.Sub(now) < window {
+			kind = KindExpiring
+		}
+		if kind == "" {
+			continue
+		}
+		key := alertKey("expiry", c.ID)
+		seen[key] = true
+		m.raise(key, Alert{
+			Kind:     kind,
+			ID:       c.ID,
+			Source:   c.Source,
+			DNSNames: c.DNSNames,
+			NotAfter: c.NotAfter,
+			Since:    now,
+		})
+	}
+	m.mu.Lock()
+	resolved := make([]Alert, 0)
+	for key, a := range m.alerts {
+		if a.Kind != KindRenewalFailed && !seen[key] {
+			delete(m.alerts, key)
+			resolved = append(resolved, a)
+		}
+	}
+	m.mu.Unlock()
+	for _, a := range resolved {
+		m.resolve(a)
+	}
+}
+
+// RenewalFailed raises a renewal alert of domain.
+func (m *Monitor) RenewalFailed(domain, source string, err error) {
+	m.raise(alertKey(KindRenewalFailed, domain), Alert{
+		Kind:     KindRenewalFailed,
+		ID:       domain,
+		Source:   source,
+		DNSNames: []string{domain},
+		Error:    err.Error(),
+		Since:    time.Now(),
+	})
+}
+
+// Renewed resolves the renewal alert of domain.
+func (m *Monitor) Renewed(domain string) {
+	key := alertKey(KindRenewalFailed, domain)
+	m.mu.Lock()
+	a, ok := m.alerts[key]
+	delete(m.alerts, key)
+	m.mu.Unlock()
+	if ok {
+		m.resolve(a)
+	}
+}
+
+// Alerts returns the open alerts.
+func (m *Monitor) Alerts() []Alert {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]Alert, 0, len(m.alerts))
+	for _, a := range m.alerts {
+		list = append(list, a)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].ID != list[j].ID {
+			return list[i].ID < list[j].ID
+		}
+		return list[i].Kind < list[j].Kind
+	})
+	return list
+}
+
+// raise stores the alert; new alerts (and expiring certificates that
+// expired) are logged and sent to the webhook
+func (m *Monitor) raise(key string, a Alert) {
+	m.mu.Lock()
+	old, exists := m.alerts[key]
+	if exists && old.Kind == a.Kind {
+		a.Since = old.Since
+	}
+	m.alerts[key] = a
+	m.mu.Unlock()
+	if exists && old.Kind == a.Kind {
+		return
+	}
+	m.Logger.Warn("certificate "+a.Kind, "id", a.ID, "source", a.Source,
+		"not_after", a.NotAfter, "err", a.Error)
+	m.notify(a)
+}
+
+func (m *Monitor) resolve(a Alert) {
+	m.Logger.Info("certificate alert resolved", "kind", a.Kind, "id", a.ID)
+	a.Resolved = true
+	m.notify(a)
+}
+
+func (m *Monitor) notify(a Alert) {
+	if m.Cfg.Webhook == "" {
+		return
+	}
+	go func() {
+		if err := m.send(a); err != nil {
+			m.Logger.Error("certificate webhook", "id", a.ID, "err", err)
+		}
+	}()
+}
+
+func (m *Monitor) send(a Alert) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, m.Cfg.Webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range m.Cfg.WebhookHeaders {
+		req.Header.Set(k, v)
+	}
+	resp, err := m.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("webhook status %v", resp.Status)
+	}
+	return nil
+}
+
+func alertKey(kind, id string) string {
+	return kind + "|" + id
+}
@@ -0,0 +1,81 @@
+package certmonitor
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCheck(t *testing.T) {
+	hooks := make(chan Alert, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer x" {
+			t.Error("missing webhook header")
+		}
+		var a Alert
+		json.NewDecoder(r.Body).Decode(&a)
+		hooks <- a
+	}))
+	defer ts.Close()
+	next := func() Alert {
+		select {
+		case a := <-hooks:
+			return a
+		case <-time.After(time.Second * 5):
+			t.Fatal("webhook not called")
+		}
+		return Alert{}
+	}
+
+	now := time.Now()
+	certs := []Certificate{
+		{ID: "ok.example.com", NotAfter: now.Add(time.Hour * 24 * 60)},
+		{ID: "soon.example.com", Source: "file", NotAfter: now.Add(time.Hour * 24 * 3)},
+	}
+	m := New(Config{
+		Window:         7,
+		Webhook:        ts.URL,
+		WebhookHeaders: map[string]string{"Authorization": "Bearer x"},
+	}, func() []Certificate { return certs })
+
+	m.Check(now)
+	if a := next(); a.Kind != KindExpiring || a.ID != "soon.example.com" || a.Resolved {
+		t.Fatalf("unexpected alert %+v", a)
+	}
+	m.Check(now.Add(time.Hour))
+	if len(m.Alerts()) != 1 {
+		t.Fatalf("unexpected alerts %+v", m.Alerts())
+	}
+	m.Check(now.Add(time.Hour * 24 * 4))
+	if a := next(); a.Kind != KindExpired {
+		t.Fatalf("expected an expired alert, got %+v", a)
+	}
+
+	certs[1].NotAfter = now.Add(time.Hour * 24 * 90)
+	m.Check(now.Add(time.Hour * 24 * 4))
+	if a := next(); a.Kind != KindExpired || !a.Resolved {
+		t.Fatalf("expected a resolved alert, got %+v", a)
+	}
+
+	m.RenewalFailed("ok.example.com", "autocert", errors.New("rate limited"))
+	m.RenewalFailed("ok.example.com", "autocert", errors.New("rate limited"))
+	if a := next(); a.Kind != KindRenewalFailed || a.Error != "rate limited" {
+		t.Fatalf("unexpected alert %+v", a)
+	}
+	m.Check(now)
+	if len(m.Alerts()) != 1 {
+		t.Fatal("checks should not resolve renewal alerts")
+	}
+	m.Renewed("ok.example.com")
+	if a := next(); !a.Resolved || len(m.Alerts()) != 0 {
+		t.Fatalf("expected a resolved renewal alert, got %+v", a)
+	}
+	select {
+	case a := <-hooks:
+		t.Fatalf("unexpected webhook %+v", a)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
@@ -0,0 +1,365 @@
+package certstore
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gabstv/sandpiper/pkg/ocspstaple"
+	"github.com/pkg/errors"
+)
+
+// Store holds the certificates served by the TLS listener. Certificates
+// are selected by the names (SANs) they contain, including wildcards.
+// Certificates loaded from files are reloaded when the files change.
+type Store struct {
+	mu        sync.RWMutex
+	certs     map[string]*entry
+	names     map[string][]*entry
+	defaultID string
+
+	// Logger receives the reload errors (default: slog.Default())
+	Logger *slog.Logger
+	// OnLoad (optional) is called after a certificate is (re)loaded
+	OnLoad func(id string, cert *tls.Certificate)
+	// OCSP (optional) staples OCSP responses to the certificates loaded
+	// from files (see RefreshOCSP)
+	OCSP *ocspstaple.Fetcher
+}
+
+type entry struct {
+	cert     *tls.Certificate
+	certFile string
+	keyFile  string
+	certMod  time.Time
+	keyMod   time.Time
+	lastErr  string
+	// next OCSP fetch and expiry of the stapled response
+	ocspNext  time.Time
+	ocspUntil time.Time
+}
+
+// New creates an empty store.
+func New() *Store {
+	return &Store{
+		certs: make(map[string]*entry),
+		names: make(map[string][]*entry),
+	}
+}
+
+// AddFile loads a certificate pair from disk and watches it for changes.
+// id identifies the pair (e.g. the route domain); the certificate is
+// served for the names it contains. The files are still watched if they
+// fail to load.
+func (s *Store) AddFile(id, certFile, keyFile string) error {
+	e := &entry{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	s.mu.Lock()
+	s.certs[id] = e
+	s.mu.Unlock()
+	_, err := s.reload(id, e)
+	return err
+}
+
+// Set adds (or replaces) a certificate that is not backed by files.
+func (s *Store) Set(id string, cert *tls.Certificate) {
+	if cert.Leaf == nil && len(cert.Certificate) > 0 {
+		cert.Leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	}
+	s.mu.Lock()
+	s.certs[id] = &entry{cert: cert}
+	s.index()
+	s.mu.Unlock()
+	s.loaded(id, cert)
+}
+
+// Get returns the certificate by id (or nil).
+func (s *Store) Get(id string) *tls.Certificate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if e := s.certs[id]; e != nil {
+		return e.cert
+	}
+	return nil
+}
+
+// Remove deletes a certificate (by id) and reports whether it existed.
+func (s *Store) Remove(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.certs[id]; !ok {
+		return false
+	}
+	delete(s.certs, id)
+	s.index()
+	return true
+}
+
+// Certificates returns the loaded certificates by id.
+func (s *Store) Certificates() map[string]*tls.Certificate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	certs := make(map[string]*tls.Certificate, len(s.certs))
+	for k, e := range s.certs {
+		if e.cert != nil {
+			certs[k] = e.cert
+		}
+	}
+	return certs
+}
+
+// SetDefault sets the certificate (by id) served when no name matches.
+func (s *Store) SetDefault(id string) {
+	s.mu.Lock()
+	s.defaultID = id
+	s.mu.Unlock()
+}
+
+// Default returns the default certificate (or nil).
+func (s *Store) Default() *tls.Certificate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if e := s.certs[s.defaultID]; e != nil {
+		return e.cert
+	}
+	return nil
+}
+
+// Match returns the certificate for the server name of hello: exact names
+// first, then wildcards. When several certificates match, the first one
+// supported by the client is returned (ECDSA is preferred over RSA).
+// It returns nil if no certificate matches.
+func (s *Store) Match(hello *tls.ClientHelloInfo) *tls.Certificate {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name == "" {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	candidates := s.names[name]
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		candidates = append(candidates[:len(candidates):len(candidates)], s.names["*"+name[i:]]...)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	for _, e := range candidates {
+		if hello.SupportsCertificate(e.cert) == nil {
+			return e.cert
+		}
+	}
+	return candidates[0].cert
+}
+
+// index rebuilds the name index (the lock must be held)
+func (s *Store) index() {
+	names := make(map[string][]*entry)
+	for _, e := range s.certs {
+		if e.cert == nil || e.cert.Leaf == nil {
+			continue
+		}
+		leaf := e.cert.Leaf
+		sans := leaf.DNSNames
+		if len(sans) == 0 && leaf.Subject.CommonName != "" {
+			sans = []string{leaf.Subject.CommonName}
+		}
+		for _, n := range sans {
+			n = strings.ToLower(n)
+			names[n] = append(names[n], e)
+		}
+	}
+	for _, list := range names {
+		sort.SliceStable(list, func(i, j int) bool {
+			return isECDSA(list[i].cert) && !isECDSA(list[j].cert)
+		})
+	}
+	s.names = names
+}
+
+func isECDSA(cert *tls.Certificate) bool {
+	_, ok := cert.PrivateKey.(*ecdsa.PrivateKey)
+	return ok
+}
+
+// Reload reloads the certificates whose files changed. A certificate that
+// fails to load keeps being served until the files are fixed.
+func (s *Store) Reload() {
+	s.mu.RLock()
+	entries := make(map[string]*entry, len(s.certs))
+	for k, v := range s.certs {
+		if v.certFile != "" {
+			entries[k] = v
+		}
+	}
+	s.mu.RUnlock()
+	for domain, e := range entries {
+		_, err := s.reload(domain, e)
+		msg := ""
+		if err != nil {
+			msg = err.Error()
+		}
+		s.mu.Lock()
+		changed := msg != e.lastErr
+		e.lastErr = msg
+		s.mu.Unlock()
+		// only report new errors (and recoveries) to avoid flooding the log
+		if err != nil && changed {
+			s.logger().Error("certificate reload", "domain", domain, "err", err)
+		} else if err == nil && changed {
+			s.logger().Info("certificate reload recovered", "domain", domain)
+		}
+	}
+}
+
+// Watch calls Reload every interval until ctx is done.
+func (s *Store) Watch(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			s.Reload()
+		}
+	}
+}
+
+// WatchOCSP calls RefreshOCSP now and every interval until ctx is done.
+func (s *Store) WatchOCSP(ctx context.Context, interval time.Duration) {
+	s.RefreshOCSP(ctx)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			s.RefreshOCSP(ctx)
+		}
+	}
+}
+
+// RefreshOCSP staples a new OCSP response to the certificates loaded from
+// files that have none or whose response is due for refresh. Must-staple
+// certificates without a valid response are reported as errors.
+func (s *Store) RefreshOCSP(ctx context.Context) {
+	if s.OCSP == nil {
+		return
+	}
+	now := time.Now()
+	due := make(map[string]*entry)
+	s.mu.RLock()
+	for k, e := range s.certs {
+		if e.certFile != "" && e.cert != nil && !now.Before(e.ocspNext) {
+			due[k] = e
+		}
+	}
+	s.mu.RUnlock()
+	for id, e := range due {
+		s.staple(ctx, id, e, now)
+	}
+}
+
+func (s *Store) staple(ctx context.Context, id string, e *entry, now time.Time) {
+	s.mu.RLock()
+	cert, until := e.cert, e.ocspUntil
+	s.mu.RUnlock()
+	mustStaple := cert.Leaf != nil && ocspstaple.MustStaple(cert.Leaf)
+	resp, err := s.OCSP.Fetch(ctx, cert)
+	if err != nil {
+		next := now.Add(time.Minute * 5)
+		if err == ocspstaple.ErrNoResponder && !mustStaple {
+			// nothing to staple until the files change
+			next = now.AddDate(100, 0, 0)
+		}
+		s.mu.Lock()
+		e.ocspNext = next
+		if e.cert == cert && len(cert.OCSPStaple) > 0 && !now.Before(until) {
+			// clients reject expired responses
+			unstapled := *cert
+			unstapled.OCSPStaple = nil
+			e.cert = &unstapled
+		}
+		s.mu.Unlock()
+		if mustStaple && !now.Before(until) {
+			s.logger().Error("must-staple certificate without a valid ocsp response", "domain", id, "err", err)
+		} else if err != ocspstaple.ErrNoResponder {
+			s.logger().Warn("ocsp stapling", "domain", id, "err", err)
+		}
+		return
+	}
+	// handshakes may be reading cert: staple a copy
+	stapled := *cert
+	stapled.OCSPStaple = resp.Raw
+	s.mu.Lock()
+	if e.cert == cert {
+		e.cert = &stapled
+		e.ocspNext = resp.Refresh
+		e.ocspUntil = resp.NextUpdate
+		if resp.NextUpdate.IsZero() {
+			e.ocspUntil = resp.Refresh
+		}
+	}
+	s.mu.Unlock()
+	s.logger().Debug("ocsp response stapled", "domain", id, "next_update", resp.NextUpdate)
+}
+
+// reload loads the files of e if their modification time changed
+func (s *Store) reload(id string, e *entry) (bool, error) {
+	cst, err := os.Stat(e.certFile)
+	if err != nil {
+		return false, errors.Wrap(err, "cert file")
+	}
+	kst, err := os.Stat(e.keyFile)
+	if err != nil {
+		return false, errors.Wrap(err, "key file")
+	}
+	s.mu.RLock()
+	unchanged := e.cert != nil && cst.ModTime().Equal(e.certMod) && kst.ModTime().Equal(e.keyMod)
+	s.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	cert, err := tls.LoadX509KeyPair(e.certFile, e.keyFile)
+	if err != nil {
+		// the cert and the key may be written one after the other; the
+		// next poll will retry
+		return false, errors.Wrapf(err, "tls.LoadX509KeyPair(%q, %q)", e.certFile, e.keyFile)
+	}
+	if cert.Leaf == nil {
+		cert.Leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	}
+	s.mu.Lock()
+	e.cert = &cert
+	e.certMod = cst.ModTime()
+	e.keyMod = kst.ModTime()
+	e.ocspNext = time.Time{}
+	e.ocspUntil = time.Time{}
+	s.index()
+	s.mu.Unlock()
+	s.loaded(id, &cert)
+	return true, nil
+}
+
+func (s *Store) loaded(id string, cert *tls.Certificate) {
+	if s.OnLoad != nil {
+		s.OnLoad(id, cert)
+	}
+}
+
+func (s *Store) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return slog.Default()
+}
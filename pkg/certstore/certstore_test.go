@@ -0,0 +1,235 @@
+package certstore
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gabstv/sandpiper/pkg/ocspstaple"
+	"golang.org/x/crypto/ocsp"
+)
+
+func writeCert(t *testing.T, dir, cn string, mod time.Time) (string, string) {
+	return writeKeyPair(t, dir, "", false, mod, cn)
+}
+
+func writeKeyPair(t *testing.T, dir, prefix string, rsaKey bool, mod time.Time, names ...string) (string, string) {
+	var (
+		priv interface{}
+		pub  interface{}
+		kder []byte
+		kpem string
+	)
+	if rsaKey {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		priv, pub = key, &key.PublicKey
+		kder, kpem = x509.MarshalPKCS1PrivateKey(key), "RSA PRIVATE KEY"
+	} else {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		priv, pub = key, &key.PublicKey
+		kder, _ = x509.MarshalECPrivateKey(key)
+		kpem = "EC PRIVATE KEY"
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, pub, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, prefix+"cert.pem")
+	keyFile := filepath.Join(dir, prefix+"key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: kpem, Bytes: kder}), 0600)
+	os.Chtimes(certFile, mod, mod)
+	os.Chtimes(keyFile, mod, mod)
+	return certFile, keyFile
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	certFile, keyFile := writeCert(t, dir, "a.example.com", now.Add(-time.Minute))
+	s := New()
+	loads := 0
+	s.OnLoad = func(domain string, cert *tls.Certificate) {
+		loads++
+	}
+	if err := s.AddFile("a.example.com", certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	first := s.Get("a.example.com")
+	if first == nil || first.Leaf.Subject.CommonName != "a.example.com" {
+		t.Fatal("the certificate should be loaded")
+	}
+	s.Reload()
+	if s.Get("a.example.com") != first || loads != 1 {
+		t.Fatal("unchanged files should not be reloaded")
+	}
+
+	writeCert(t, dir, "a.example.com", now)
+	s.Reload()
+	second := s.Get("a.example.com")
+	if second == first || loads != 2 {
+		t.Fatal("changed files should be reloaded")
+	}
+
+	os.WriteFile(certFile, []byte("broken"), 0644)
+	os.Chtimes(certFile, now.Add(time.Minute), now.Add(time.Minute))
+	s.Reload()
+	if s.Get("a.example.com") != second {
+		t.Fatal("a broken certificate should keep the previous one")
+	}
+}
+
+func TestMatch(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	s := New()
+	c, k := writeKeyPair(t, dir, "wild-rsa-", true, now, "*.example.com", "example.com")
+	s.AddFile("rsa", c, k)
+	c, k = writeKeyPair(t, dir, "wild-ec-", false, now, "*.example.com")
+	s.AddFile("ecdsa", c, k)
+	c, k = writeKeyPair(t, dir, "default-", false, now, "default.local")
+	s.AddFile("default", c, k)
+	s.SetDefault("default")
+
+	ecdsaHello := &tls.ClientHelloInfo{
+		ServerName:        "api.example.com",
+		SupportedVersions: []uint16{tls.VersionTLS13},
+		SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256, tls.PSSWithSHA256},
+	}
+	if cert := s.Match(ecdsaHello); cert != s.Get("ecdsa") {
+		t.Fatal("wildcard match should prefer the ECDSA certificate")
+	}
+	rsaHello := &tls.ClientHelloInfo{
+		ServerName:        "api.example.com",
+		SupportedVersions: []uint16{tls.VersionTLS13},
+		SignatureSchemes:  []tls.SignatureScheme{tls.PSSWithSHA256},
+	}
+	if cert := s.Match(rsaHello); cert != s.Get("rsa") {
+		t.Fatal("clients without ECDSA support should get the RSA certificate")
+	}
+	if cert := s.Match(&tls.ClientHelloInfo{ServerName: "Example.com."}); cert != s.Get("rsa") {
+		t.Fatal("exact SAN should match")
+	}
+	if cert := s.Match(&tls.ClientHelloInfo{ServerName: "a.b.example.com"}); cert != nil {
+		t.Fatal("wildcards should only match one label")
+	}
+	if s.Default() != s.Get("default") {
+		t.Fatal("unexpected default certificate")
+	}
+	if !s.Remove("ecdsa") || s.Remove("ecdsa") {
+		t.Fatal("Remove should report if the certificate existed")
+	}
+	if cert := s.Match(ecdsaHello); cert != s.Get("rsa") {
+		t.Fatal("a removed certificate should not be matched")
+	}
+	if n := len(s.Certificates()); n != 2 {
+		t.Fatalf("expected 2 certificates, got %v", n)
+	}
+}
+
+func TestRefreshOCSP(t *testing.T) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour * 24),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, _ := x509.CreateCertificate(rand.Reader, caTpl, caTpl, &caKey.PublicKey, caKey)
+	ca, _ := x509.ParseCertificate(caDER)
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		body, _ := io.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, _ := ocsp.CreateResponse(ca, ca, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   time.Now(),
+			NextUpdate:   time.Now().Add(time.Hour),
+		}, caKey)
+		w.Write(resp)
+	}))
+	defer ts.Close()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour * 24),
+		OCSPServer:   []string{ts.URL},
+	}, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kder, _ := x509.MarshalECPrivateKey(key)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	chain := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})...)
+	os.WriteFile(certFile, chain, 0644)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder}), 0600)
+
+	s := New()
+	s.OCSP = &ocspstaple.Fetcher{}
+	if err := s.AddFile("example.com", certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	s.RefreshOCSP(context.Background())
+	cert := s.Match(&tls.ClientHelloInfo{ServerName: "example.com"})
+	if cert == nil || len(cert.OCSPStaple) == 0 {
+		t.Fatal("the ocsp response should be stapled")
+	}
+	s.RefreshOCSP(context.Background())
+	if requests != 1 || s.Get("example.com") != cert {
+		t.Fatal("the response should be cached until it is due for refresh")
+	}
+
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	s.Reload()
+	if len(s.Get("example.com").OCSPStaple) != 0 {
+		t.Fatal("a reloaded certificate should not keep the previous response")
+	}
+	s.RefreshOCSP(context.Background())
+	if requests != 2 || len(s.Get("example.com").OCSPStaple) == 0 {
+		t.Fatal("a reloaded certificate should be stapled again")
+	}
+}
@@ -0,0 +1,163 @@
+package errorpage
+
+import (
+	"bytes"
+	"encoding/json"
+	htmltemplate "html/template"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/gabstv/sandpiper/pkg/util"
+	"github.com/pkg/errors"
+)
+
+// Config configures the error pages of the server or of a route.
+type Config struct {
+	// HTML is the path of an html/template used when the client accepts
+	// text/html
+	HTML string `json:"html,omitempty" yaml:"html"`
+	// JSON is the path of a text/template used when the client accepts
+	// application/json
+	JSON string `json:"json,omitempty" yaml:"json"`
+	// HideDetails replaces internal error messages (like upstream dial
+	// errors) with the status text
+	HideDetails bool `json:"hide_details,omitempty" yaml:"hide_details"`
+}
+
+// Data is passed to the templates.
+type Data struct {
+	Status     int
+	StatusText string
+	Message    string
+	RequestID  string
+	Host       string
+	Path       string
+}
+
+// Pages renders error responses. A nil *Pages uses the default templates.
+type Pages struct {
+	html *htmltemplate.Template
+	json *texttemplate.Template
+	hide bool
+}
+
+var (
+	defaultHTML = htmltemplate.Must(htmltemplate.New("html").Parse(`<!DOCTYPE html>
+<html><head><title>{{.Status}} {{.StatusText}}</title></head>
+<body><h1>{{.Status}} {{.StatusText}}</h1><p>{{.Message}}</p>{{if .RequestID}}<p><small>request id: {{.RequestID}}</small></p>{{end}}</body></html>
+`))
+	defaultJSON = texttemplate.Must(texttemplate.New("json").Funcs(texttemplate.FuncMap{
+		"json": jsonString,
+	}).Parse(`{"status":{{.Status}},"error":{{json .Message}}{{if .RequestID}},"request_id":{{json .RequestID}}{{end}}}
+`))
+)
+
+// New loads the templates of cfg. Missing templates use the defaults.
+func New(cfg Config) (*Pages, error) {
+	p := &Pages{
+		html: defaultHTML,
+		json: defaultJSON,
+		hide: cfg.HideDetails,
+	}
+	if cfg.HTML != "" {
+		t, err := htmltemplate.ParseFiles(cfg.HTML)
+		if err != nil {
+			return nil, errors.Wrap(err, "html error page")
+		}
+		p.html = t
+	}
+	if cfg.JSON != "" {
+		t, err := texttemplate.New("").Funcs(texttemplate.FuncMap{
+			"json": jsonString,
+		}).ParseFiles(cfg.JSON)
+		if err != nil {
+			return nil, errors.Wrap(err, "json error page")
+		}
+		p.json = t.Lookup(t.Templates()[0].Name())
+	}
+	return p, nil
+}
+
+// Write renders the error response. The format is chosen by the Accept
+// header: html, json or plain text. detail is only shown if the pages do
+// not hide details.
+func (p *Pages) Write(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	d := Data{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Message:    detail,
+		RequestID:  util.RequestID(r.Context()),
+		Host:       r.Host,
+		Path:       r.URL.Path,
+	}
+	if d.Message == "" || (p != nil && p.hide) {
+		d.Message = d.StatusText
+	}
+	htmlT, jsonT := defaultHTML, defaultJSON
+	if p != nil {
+		htmlT, jsonT = p.html, p.json
+	}
+	var (
+		buf   bytes.Buffer
+		ctype string
+		err   error
+	)
+	switch Negotiate(r.Header.Get("Accept")) {
+	case "text/html":
+		ctype = "text/html; charset=utf-8"
+		err = htmlT.Execute(&buf, d)
+	case "application/json":
+		ctype = "application/json"
+		err = jsonT.Execute(&buf, d)
+	}
+	if ctype == "" || err != nil {
+		util.Error(w, r, d.Message, status)
+		return
+	}
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", ctype)
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// Negotiate returns "text/html", "application/json" or "" (plain text)
+// depending on which type has the highest quality in the Accept header.
+// Wildcards are ignored so clients like curl get plain text.
+func Negotiate(accept string) string {
+	best, bestq := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		var t string
+		switch {
+		case mt == "text/html" || mt == "application/xhtml+xml":
+			t = "text/html"
+		case mt == "application/json" || strings.HasSuffix(mt, "+json"):
+			t = "application/json"
+		default:
+			continue
+		}
+		if q > bestq {
+			best, bestq = t, q
+		}
+	}
+	return best
+}
+
+func jsonString(v string) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
@@ -0,0 +1,68 @@
+package errorpage
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	cases := map[string]string{
+		"":                                    "",
+		"*/*":                                 "",
+		"text/html,application/xhtml+xml,*/*": "text/html",
+		"application/json":                    "application/json",
+		"application/problem+json":            "application/json",
+		"text/html;q=0.5, application/json":   "application/json",
+	}
+	for accept, want := range cases {
+		if got := Negotiate(accept); got != want {
+			t.Fatalf("Negotiate(%q) should be %q but it is %q", accept, want, got)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	r := httptest.NewRequest("GET", "/x", nil)
+	r.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	var p *Pages
+	p.Write(w, r, 502, `dial tcp: "refused"`)
+	if w.Code != 502 || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("unexpected response %v %v", w.Code, w.Header())
+	}
+	v := struct {
+		Status int    `json:"status"`
+		Error  string `json:"error"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+		t.Fatal(err, w.Body.String())
+	}
+	if v.Status != 502 || v.Error != `dial tcp: "refused"` {
+		t.Fatalf("unexpected body %v", w.Body.String())
+	}
+
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "error.html")
+	os.WriteFile(fn, []byte("<p>oops {{.Status}} {{.Message}}</p>"), 0644)
+	p, err := New(Config{HTML: fn, HideDetails: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Accept", "text/html")
+	w = httptest.NewRecorder()
+	p.Write(w, r, 504, "dial tcp: i/o timeout")
+	if body := w.Body.String(); body != "<p>oops 504 Gateway Timeout</p>" {
+		t.Fatalf("unexpected body %q", body)
+	}
+
+	r.Header.Del("Accept")
+	w = httptest.NewRecorder()
+	p.Write(w, r, 404, "")
+	if !strings.HasPrefix(w.Body.String(), "Not Found") {
+		t.Fatalf("unexpected body %q", w.Body.String())
+	}
+}
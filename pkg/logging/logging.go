@@ -0,0 +1,76 @@
+package logging
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Formats
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Config configures the server logger.
+type Config struct {
+	// Level: "debug", "info" (default), "warn" or "error"
+	Level string `json:"level,omitempty" yaml:"level"`
+	// Format: "text" (default) or "json"
+	Format string `json:"format,omitempty" yaml:"format"`
+	// Output: "stderr" (default), "stdout" or a file path
+	Output string `json:"output,omitempty" yaml:"output"`
+}
+
+// ParseLevel converts a level name to a slog.Level.
+func ParseLevel(v string) (slog.Level, error) {
+	var l slog.Level
+	if v == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := l.UnmarshalText([]byte(strings.ToUpper(v))); err != nil {
+		return slog.LevelInfo, errors.Errorf("invalid log level %q", v)
+	}
+	return l, nil
+}
+
+// NewHandler creates a slog.Handler from the config.
+// debug forces the debug level.
+func NewHandler(cfg Config, debug bool) (slog.Handler, error) {
+	level, err := ParseLevel(cfg.Level)
+	if err != nil {
+		return nil, err
+	}
+	if debug {
+		level = slog.LevelDebug
+	}
+	var w io.Writer
+	switch cfg.Output {
+	case "", "stderr":
+		w = os.Stderr
+	case "stdout":
+		w = os.Stdout
+	default:
+		f, err := os.OpenFile(cfg.Output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, errors.Wrap(err, "log output")
+		}
+		w = f
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	switch cfg.Format {
+	case "", FormatText:
+		return slog.NewTextHandler(w, opts), nil
+	case FormatJSON:
+		return slog.NewJSONHandler(w, opts), nil
+	}
+	return nil, errors.Errorf("invalid log format %q", cfg.Format)
+}
+
+// Discard returns a logger that drops everything.
+func Discard() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelError + 1}))
+}
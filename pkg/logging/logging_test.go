@@ -0,0 +1,41 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+)
+
+func TestParseLevel(t *testing.T) {
+	cases := map[string]slog.Level{
+		"":      slog.LevelInfo,
+		"debug": slog.LevelDebug,
+		"WARN":  slog.LevelWarn,
+		"error": slog.LevelError,
+	}
+	for v, want := range cases {
+		got, err := ParseLevel(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Fatalf("ParseLevel(%q) should be %v but it is %v", v, want, got)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Fatal("invalid level should return an error")
+	}
+}
+
+func TestNewHandler(t *testing.T) {
+	h, err := NewHandler(Config{Level: "error", Format: "json"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.Enabled(context.Background(), slog.LevelDebug) {
+		t.Fatal("debug should force the debug level")
+	}
+	if _, err := NewHandler(Config{Format: "xml"}, false); err == nil {
+		t.Fatal("invalid format should return an error")
+	}
+}
@@ -0,0 +1,297 @@
+// Package metrics is a small, dependency free implementation of the
+// Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are the default histogram buckets (seconds).
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Sample is a single value of a GaugeFunc or CounterFunc.
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds the metrics and serves them over http.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) add(c collector) {
+	r.mu.Lock()
+	r.collectors = append(r.collectors, c)
+	r.mu.Unlock()
+}
+
+// Write writes all metrics in the text format.
+func (r *Registry) Write(w io.Writer) {
+	r.mu.Lock()
+	collectors := append([]collector{}, r.collectors...)
+	r.mu.Unlock()
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.write(bw)
+	}
+	bw.Flush()
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.Write(w)
+}
+
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) header(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, d.help, d.name, d.typ)
+}
+
+func (d *desc) key(lv []string) string {
+	if len(lv) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", d.name, len(d.labels), len(lv)))
+	}
+	return strings.Join(lv, "\xff")
+}
+
+// Counter is a monotonic counter with labels.
+type Counter struct {
+	desc
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewCounter registers a counter.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{
+		desc:   desc{name: name, help: help, typ: "counter", labels: labels},
+		values: make(map[string]float64),
+	}
+	r.add(c)
+	return c
+}
+
+// Add increments the counter of the label values by v.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	k := c.key(labelValues)
+	c.mu.Lock()
+	c.values[k] += v
+	c.mu.Unlock()
+}
+
+// Inc increments the counter of the label values by 1.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.header(w)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeValues(w, &c.desc, c.values)
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	Counter
+}
+
+// NewGauge registers a gauge.
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{
+		Counter: Counter{
+			desc:   desc{name: name, help: help, typ: "gauge", labels: labels},
+			values: make(map[string]float64),
+		},
+	}
+	r.add(g)
+	return g
+}
+
+// Set sets the gauge of the label values.
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	k := g.key(labelValues)
+	g.mu.Lock()
+	g.values[k] = v
+	g.mu.Unlock()
+}
+
+// Delete removes the gauge of the label values.
+func (g *Gauge) Delete(labelValues ...string) {
+	k := g.key(labelValues)
+	g.mu.Lock()
+	delete(g.values, k)
+	g.mu.Unlock()
+}
+
+type gaugeFunc struct {
+	desc
+	fn func() []Sample
+}
+
+// NewGaugeFunc registers a gauge whose samples are collected by fn at
+// scrape time.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() []Sample, labels ...string) {
+	r.add(&gaugeFunc{
+		desc: desc{name: name, help: help, typ: "gauge", labels: labels},
+		fn:   fn,
+	})
+}
+
+// NewCounterFunc registers a counter whose samples are collected by fn at
+// scrape time. fn must return values that never decrease.
+func (r *Registry) NewCounterFunc(name, help string, fn func() []Sample, labels ...string) {
+	r.add(&gaugeFunc{
+		desc: desc{name: name, help: help, typ: "counter", labels: labels},
+		fn:   fn,
+	})
+}
+
+func (g *gaugeFunc) write(w *bufio.Writer) {
+	g.header(w)
+	values := make(map[string]float64)
+	for _, s := range g.fn() {
+		values[g.key(s.LabelValues)] = s.Value
+	}
+	writeValues(w, &g.desc, values)
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram registers a histogram. buckets must be sorted; nil uses
+// DefBuckets.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	h := &Histogram{
+		desc:    desc{name: name, help: help, typ: "histogram", labels: labels},
+		buckets: buckets,
+		values:  make(map[string]*histogramValue),
+	}
+	r.add(h)
+	return h
+}
+
+// Observe adds an observation.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	k := h.key(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hv := h.values[k]
+	if hv == nil {
+		hv = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[k] = hv
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			hv.counts[i]++
+		}
+	}
+	hv.count++
+	hv.sum += v
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.header(w)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, k := range sortedKeys(h.values) {
+		hv := h.values[k]
+		lv := splitKey(k, len(h.labels))
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(h.labels, lv, "le", formatFloat(b)), hv.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(h.labels, lv, "le", "+Inf"), hv.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labelString(h.labels, lv), formatFloat(hv.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelString(h.labels, lv), hv.count)
+	}
+}
+
+func writeValues(w *bufio.Writer, d *desc, values map[string]float64) {
+	for _, k := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s%s %s\n", d.name, labelString(d.labels, splitKey(k, len(d.labels))), formatFloat(values[k]))
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func splitKey(k string, n int) []string {
+	if n == 0 {
+		return nil
+	}
+	return strings.Split(k, "\xff")
+}
+
+// labelString formats {a="1",b="2"}; extra is an optional name/value pair.
+func labelString(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(names)+1)
+	for i, n := range names {
+		parts = append(parts, n+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	if len(extra) == 2 {
+		parts = append(parts, extra[0]+`="`+labelEscaper.Replace(extra[1])+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,43 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("requests_total", "Requests.", "route", "code")
+	c.Inc("a.com", "2xx")
+	c.Add(2, "a.com", "2xx")
+	c.Inc(`b"c`, "5xx")
+	h := r.NewHistogram("duration_seconds", "Duration.", []float64{0.1, 1}, "route")
+	h.Observe(0.05, "a.com")
+	h.Observe(0.5, "a.com")
+	r.NewGaugeFunc("up", "Up.", func() []Sample {
+		return []Sample{{Value: 1}}
+	})
+	r.NewCounterFunc("dropped_total", "Dropped.", func() []Sample {
+		return []Sample{{Value: 4}}
+	})
+	buf := new(bytes.Buffer)
+	r.Write(buf)
+	out := buf.String()
+	for _, line := range []string{
+		"# TYPE requests_total counter",
+		`requests_total{route="a.com",code="2xx"} 3`,
+		`requests_total{route="b\"c",code="5xx"} 1`,
+		`duration_seconds_bucket{route="a.com",le="0.1"} 1`,
+		`duration_seconds_bucket{route="a.com",le="1"} 2`,
+		`duration_seconds_bucket{route="a.com",le="+Inf"} 2`,
+		`duration_seconds_count{route="a.com"} 2`,
+		"up 1",
+		"# TYPE dropped_total counter",
+		"dropped_total 4",
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Fatalf("output should contain %q\n%v", line, out)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+// Package ocspstaple fetches the OCSP responses stapled to the served
+// certificates.
+package ocspstaple
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ocsp"
+)
+
+// ErrNoResponder is returned for certificates without an OCSP server.
+var ErrNoResponder = errors.New("the certificate has no OCSP responder")
+
+// id-pe-tlsfeature (RFC 7633)
+var oidTLSFeature = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24}
+
+// status_request
+const featureStatusRequest = 5
+
+// maxResponseBytes limits the responder and issuer downloads
+const maxResponseBytes = 1 << 20
+
+// Response is a verified "good" OCSP response.
+type Response struct {
+	Raw        []byte
+	ThisUpdate time.Time
+	NextUpdate time.Time
+	// Refresh is when a new response should be fetched
+	Refresh time.Time
+}
+
+// Fetcher requests OCSP responses from the certificate responders.
+type Fetcher struct {
+	// Client (default: http.Client with a 10 seconds timeout)
+	Client *http.Client
+}
+
+// Fetch requests and verifies the OCSP response of the leaf of cert. The
+// issuer is the second certificate of the chain or, if missing, the one
+// of the leaf's issuing certificate URL.
+func (f *Fetcher) Fetch(ctx context.Context, cert *tls.Certificate) (*Response, error) {
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("empty certificate")
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+	if len(leaf.OCSPServer) == 0 {
+		return nil, ErrNoResponder
+	}
+	issuer, err := f.issuer(ctx, cert, leaf)
+	if err != nil {
+		return nil, err
+	}
+	reqb, err := ocsp.CreateRequest(leaf, issuer, &ocsp.RequestOptions{Hash: crypto.SHA1})
+	if err != nil {
+		return nil, errors.Wrap(err, "ocsp request")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, leaf.OCSPServer[0], bytes.NewReader(reqb))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	req.Header.Set("Accept", "application/ocsp-response")
+	raw, err := f.get(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "ocsp responder")
+	}
+	resp, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		return nil, errors.Wrap(err, "ocsp response")
+	}
+	switch resp.Status {
+	case ocsp.Good:
+	case ocsp.Revoked:
+		return nil, errors.Errorf("the certificate was revoked at %v", resp.RevokedAt)
+	default:
+		return nil, errors.New("the certificate status is unknown to the responder")
+	}
+	now := time.Now()
+	if !resp.NextUpdate.IsZero() && now.After(resp.NextUpdate) {
+		return nil, errors.Errorf("the ocsp response expired at %v", resp.NextUpdate)
+	}
+	return &Response{
+		Raw:        raw,
+		ThisUpdate: resp.ThisUpdate,
+		NextUpdate: resp.NextUpdate,
+		Refresh:    refreshAt(resp.ThisUpdate, resp.NextUpdate, now),
+	}, nil
+}
+
+// refreshAt is halfway through the validity of the response (or one hour
+// if the responder did not set NextUpdate), but at least one minute ahead
+func refreshAt(thisUpdate, nextUpdate, now time.Time) time.Time {
+	at := now.Add(time.Hour)
+	if !nextUpdate.IsZero() {
+		at = thisUpdate.Add(nextUpdate.Sub(thisUpdate) / 2)
+	}
+	if min := now.Add(time.Minute); at.Before(min) {
+		at = min
+	}
+	return at
+}
+
+func (f *Fetcher) issuer(ctx context.Context, cert *tls.Certificate, leaf *x509.Certificate) (*x509.Certificate, error) {
+	if len(cert.Certificate) > 1 {
+		return x509.ParseCertificate(cert.Certificate[1])
+	}
+	if len(leaf.IssuingCertificateURL) == 0 {
+		return nil, errors.New("the issuer is not in the chain and the certificate has no issuer url")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, leaf.IssuingCertificateURL[0], nil)
+	if err != nil {
+		return nil, err
+	}
+	data, err := f.get(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "issuer certificate")
+	}
+	if b, _ := pem.Decode(data); b != nil {
+		data = b.Bytes
+	}
+	return x509.ParseCertificate(data)
+}
+
+func (f *Fetcher) get(req *http.Request) ([]byte, error) {
+	client := f.Client
+	if client == nil {
+		client = &http.Client{Timeout: time.Second * 10}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("status %v", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxResponseBytes))
+}
+
+// MustStaple reports whether the certificate requires a stapled OCSP
+// response (TLS feature status_request).
+func MustStaple(leaf *x509.Certificate) bool {
+	for _, ext := range leaf.Extensions {
+		if !ext.Id.Equal(oidTLSFeature) {
+			continue
+		}
+		var features []int
+		if _, err := asn1.Unmarshal(ext.Value, &features); err != nil {
+			return false
+		}
+		for _, v := range features {
+			if v == featureStatusRequest {
+				return true
+			}
+		}
+	}
+	return false
+}
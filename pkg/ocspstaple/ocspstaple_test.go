@@ -0,0 +1,153 @@
+package ocspstaple
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour * 24),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) leaf(t *testing.T, responder, issuerURL string, mustStaple bool) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour * 24),
+	}
+	if responder != "" {
+		tpl.OCSPServer = []string{responder}
+	}
+	if issuerURL != "" {
+		tpl.IssuingCertificateURL = []string{issuerURL}
+	}
+	if mustStaple {
+		v, _ := asn1.Marshal([]int{featureStatusRequest})
+		tpl.ExtraExtensions = []pkix.Extension{{Id: oidTLSFeature, Value: v}}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return &tls.Certificate{Certificate: [][]byte{der, ca.cert.Raw}, PrivateKey: key, Leaf: leaf}
+}
+
+// responder answers every request with status
+func (ca *testCA) responder(t *testing.T, status int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/issuer" {
+			w.Write(ca.cert.Raw)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		now := time.Now().Truncate(time.Minute)
+		resp, err := ocsp.CreateResponse(ca.cert, ca.cert, ocsp.Response{
+			Status:       status,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   now,
+			NextUpdate:   now.Add(time.Hour * 4),
+			RevokedAt:    now,
+		}, ca.key)
+		if err != nil {
+			t.Error(err)
+		}
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(resp)
+	}))
+}
+
+func TestFetch(t *testing.T) {
+	ca := newTestCA(t)
+	ts := ca.responder(t, ocsp.Good)
+	defer ts.Close()
+	f := &Fetcher{}
+	ctx := context.Background()
+
+	cert := ca.leaf(t, ts.URL, "", false)
+	resp, err := f.Fetch(ctx, cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Raw) == 0 || resp.NextUpdate.Sub(resp.ThisUpdate) != time.Hour*4 {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	if want := resp.ThisUpdate.Add(time.Hour * 2); !resp.Refresh.Equal(want) {
+		t.Fatalf("refresh = %v, want %v", resp.Refresh, want)
+	}
+
+	// issuer downloaded from the issuing certificate url
+	cert = ca.leaf(t, ts.URL, ts.URL+"/issuer", false)
+	cert.Certificate = cert.Certificate[:1]
+	if _, err := f.Fetch(ctx, cert); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Fetch(ctx, ca.leaf(t, "", "", false)); err != ErrNoResponder {
+		t.Fatalf("expected ErrNoResponder, got %v", err)
+	}
+
+	revoked := ca.responder(t, ocsp.Revoked)
+	defer revoked.Close()
+	if _, err := f.Fetch(ctx, ca.leaf(t, revoked.URL, "", false)); err == nil {
+		t.Fatal("revoked certificates should not be stapled")
+	}
+}
+
+func TestMustStaple(t *testing.T) {
+	ca := newTestCA(t)
+	if MustStaple(ca.leaf(t, "", "", false).Leaf) {
+		t.Fatal("unexpected must-staple")
+	}
+	if !MustStaple(ca.leaf(t, "", "", true).Leaf) {
+		t.Fatal("expected must-staple")
+	}
+}
@@ -0,0 +1,79 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// MemoryStore is an in-memory Store.
+type MemoryStore struct {
+	sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	// rate and burst of the last Take (routes can share a store)
+	rate  float64
+	burst int
+}
+
+// NewMemoryStore creates an empty in-memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Take implements Store.
+func (m *MemoryStore) Take(key string, rate float64, burst int, now time.Time) Result {
+	m.Lock()
+	defer m.Unlock()
+	if now.Sub(m.lastSweep) > time.Minute {
+		m.sweep(now)
+	}
+	b := m.buckets[key]
+	if b == nil {
+		b = &bucket{tokens: float64(burst), last: now}
+		m.buckets[key] = b
+	}
+	b.rate, b.burst = rate, burst
+	b.refill(rate, burst, now)
+	res := Result{
+		Limit: burst,
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		res.Allowed = true
+	} else if rate > 0 {
+		res.RetryAfter = time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	res.Remaining = int(math.Floor(b.tokens))
+	if rate > 0 {
+		res.Reset = time.Duration((float64(burst) - b.tokens) / rate * float64(time.Second))
+	}
+	return res
+}
+
+// sweep removes the buckets that would be full by now (with their own
+// rate and burst).
+func (m *MemoryStore) sweep(now time.Time) {
+	m.lastSweep = now
+	for k, b := range m.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*b.rate >= float64(b.burst) {
+			delete(m.buckets, k)
+		}
+	}
+}
+
+func (b *bucket) refill(rate float64, burst int, now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+}
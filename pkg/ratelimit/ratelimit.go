@@ -0,0 +1,133 @@
+package ratelimit
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the token bucket configuration of a route.
+type Config struct {
+	// Rate is the amount of tokens (requests) added per second
+	Rate float64 `json:"rate" yaml:"rate"`
+	// Burst is the bucket size (default: Rate rounded up)
+	Burst int `json:"burst,omitempty" yaml:"burst"`
+	// Key selects how clients are identified:
+	//   "ip" (default), "header:<Name>" or "jwt_sub".
+	// The header and the JWT are not verified, so a client can change
+	// them to get a new bucket: only use them behind an auth layer that
+	// rejects invalid keys and tokens (before the request reaches
+	// sandpiper). Use "ip" for untrusted clients.
+	Key string `json:"key,omitempty" yaml:"key"`
+}
+
+// Result is the outcome of a Take call.
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// RetryAfter is the time until the next token is available
+	RetryAfter time.Duration
+	// Reset is the time until the bucket is full again
+	Reset time.Duration
+}
+
+// Store holds the limiter state. Implement it to share the state between
+// multiple sandpiper instances.
+type Store interface {
+	Take(key string, rate float64, burst int, now time.Time) Result
+}
+
+// Limiter enforces a Config using a Store.
+type Limiter struct {
+	cfg   Config
+	store Store
+	name  string
+}
+
+// New creates a limiter. The name is used to namespace the store keys.
+func New(name string, cfg Config, store Store) *Limiter {
+	if cfg.Burst <= 0 {
+		cfg.Burst = int(math.Ceil(cfg.Rate))
+	}
+	if store == nil {
+		store = NewMemoryStore()
+	}
+	return &Limiter{
+		cfg:   cfg,
+		store: store,
+		name:  name,
+	}
+}
+
+// Take consumes a token for the client of r.
+// clientIP is used when the key is "ip" or when the configured key is
+// missing from the request.
+func (l *Limiter) Take(r *http.Request, clientIP net.IP) Result {
+	key := l.key(r)
+	if key == "" {
+		key = "ip:" + clientIP.String()
+	}
+	return l.store.Take(l.name+"|"+key, l.cfg.Rate, l.cfg.Burst, time.Now())
+}
+
+func (l *Limiter) key(r *http.Request) string {
+	switch {
+	case l.cfg.Key == "" || l.cfg.Key == "ip":
+		return ""
+	case strings.HasPrefix(l.cfg.Key, "header:"):
+		if v := r.Header.Get(strings.TrimPrefix(l.cfg.Key, "header:")); v != "" {
+			return "h:" + v
+		}
+	case l.cfg.Key == "jwt_sub":
+		if sub := jwtSubject(r); sub != "" {
+			return "sub:" + sub
+		}
+	}
+	return ""
+}
+
+// WriteHeaders sets the RateLimit-* headers (and Retry-After when the
+// request was not allowed).
+func WriteHeaders(h http.Header, res Result) {
+	h.Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+	if !res.Allowed {
+		h.Set("Retry-After", strconv.Itoa(ceilSeconds(res.RetryAfter)))
+	}
+}
+
+// jwtSubject returns the "sub" claim of a bearer token.
+// The signature is NOT verified; the value is only used as a bucket key
+// (see Config.Key).
+func jwtSubject(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "bearer ") {
+		return ""
+	}
+	parts := strings.Split(strings.TrimSpace(auth[7:]), ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ""
+	}
+	claims := struct {
+		Sub string `json:"sub"`
+	}{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+	return claims.Sub
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
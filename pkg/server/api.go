@@ -3,26 +3,51 @@ package server
 import (
 	"context"
 	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
 	"path/filepath"
 	"time"
 
 	"github.com/gabstv/freeport"
 	"github.com/gabstv/sandpiper/api"
+	"github.com/gabstv/sandpiper/internal/pkg/ipacl"
 	"github.com/gabstv/sandpiper/internal/pkg/route"
 	"github.com/gin-gonic/gin"
 )
 
-func runAPIV1(ctx context.Context, sv Server, listen, key, indexfile string, hostFolders []string, debug bool) {
+func runAPIV1(ctx context.Context, sv Server, listen, key, indexfile string, hostFolders []string, debug bool, acl *ipacl.ACL, trusted []*net.IPNet, metricsHandler http.Handler, logger *slog.Logger) {
 	if !debug {
 		gin.SetMode(gin.ReleaseMode)
 	}
-	r := gin.Default()
+	r := gin.New()
+	r.Use(gin.Recovery(), func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		logger.Debug("api request", "method", c.Request.Method, "path", c.Request.URL.Path,
+			"status", c.Writer.Status(), "duration", time.Since(start))
+	})
+
+	if acl != nil {
+		// requests proxied through the APIDomain route arrive from loopback
+		loopback, _ := ipacl.ParseNets([]string{"127.0.0.0/8", "::1"})
+		trusted = append(loopback, trusted...)
+		r.Use(func(c *gin.Context) {
+			if !acl.Allowed(ipacl.ClientIP(c.Request, trusted)) {
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+			c.Next()
+		})
+	}
 
 	r.GET("/health-check", func(c *gin.Context) {
 		c.String(http.StatusOK, "OK")
 	})
 
+	// prometheus metrics (MetricsAllow or the API key)
+	r.GET("/metrics", gin.WrapH(metricsHandler))
+
 	if indexfile != "" {
 		r.StaticFile("/", indexfile)
 	} else {
@@ -98,6 +123,149 @@ func runAPIV1(ctx context.Context, sv Server, listen, key, indexfile string, hos
 		})
 	})
 
+	// maintenance mode (global or per route)
+	getMaintenance := func(c *gin.Context) {
+		cfg, err := sv.Maintenance(c.Param("domain"))
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"success": false,
+				"error":   err.Error(),
+			})
+			return
+		}
+		// the token is a secret
+		cfg.BypassToken = ""
+		c.JSON(http.StatusOK, gin.H{
+			"success":     true,
+			"maintenance": cfg,
+		})
+	}
+	putMaintenance := func(c *gin.Context) {
+		jd := route.MaintenanceConfig{}
+		if err := c.BindJSON(&jd); err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"success": false,
+				"error":   "json parse error: " + err.Error(),
+			})
+			return
+		}
+		if err := sv.SetMaintenance(c.Param("domain"), jd); err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"success": false,
+				"error":   err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+		})
+	}
+	g.GET("/maintenance", getMaintenance)
+	g.PUT("/maintenance", putMaintenance)
+	g.GET("/maintenance/:domain", getMaintenance)
+	g.PUT("/maintenance/:domain", putMaintenance)
+
+	// upstream group weights of SPLIT routes
+	g.GET("/split/:domain", func(c *gin.Context) {
+		weights, err := sv.SplitWeights(c.Param("domain"))
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"success": false,
+				"error":   err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"weights": weights,
+		})
+	})
+	g.PUT("/split/:domain", func(c *gin.Context) {
+		jd := struct {
+			Weights map[string]int `json:"weights"`
+		}{}
+		if err := c.BindJSON(&jd); err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"success": false,
+				"error":   "json parse error: " + err.Error(),
+			})
+			return
+		}
+		if err := sv.SetSplitWeights(c.Param("domain"), jd.Weights); err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"success": false,
+				"error":   err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+		})
+	})
+
+	// certificates
+	g.GET("/certificates", func(c *gin.Context) {
+		certs, err := sv.Certificates()
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"success": false,
+				"error":   err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"success":      true,
+			"certificates": certs,
+		})
+	})
+	g.GET("/certificates/alerts", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"alerts":  sv.CertificateAlerts(),
+		})
+	})
+	g.GET("/certificates/dev-ca", func(c *gin.Context) {
+		ca, err := sv.DevCA()
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"success": false,
+				"error":   err.Error(),
+			})
+			return
+		}
+		c.Data(http.StatusOK, "application/x-pem-file", ca)
+	})
+	certOp := func(fn func(domain string) error) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			if err := fn(c.Param("domain")); err != nil {
+				c.JSON(http.StatusOK, gin.H{
+					"success": false,
+					"error":   err.Error(),
+				})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{
+				"success": true,
+			})
+		}
+	}
+	g.POST("/certificates/:domain/renew", certOp(sv.RenewCertificate))
+	g.POST("/certificates/:domain/revoke", certOp(sv.RevokeCertificate))
+	g.DELETE("/certificates/:domain", certOp(sv.DeleteCertificate))
+	g.PUT("/certificates/:domain", func(c *gin.Context) {
+		jd := &api.CertificatePair{}
+		if err := c.BindJSON(jd); err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"success": false,
+				"error":   "json parse error: " + err.Error(),
+			})
+			return
+		}
+		certOp(func(domain string) error {
+			return sv.PutCertificate(domain, []byte(jd.Cert), []byte(jd.Key))
+		})(c)
+	})
+
 	// UPSERT a new route!
 	g.PUT("/route", func(c *gin.Context) {
 		jd := &api.NewRoute{}
@@ -114,6 +282,7 @@ func runAPIV1(ctx context.Context, sv Server, listen, key, indexfile string, hos
 			Server: route.RouteServer{
 				OutAddress: jd.OutPath,
 			},
+			Rules: jd.Rules,
 		}
 
 		newport := 0
@@ -178,7 +347,11 @@ func runAPIV1(ctx context.Context, sv Server, listen, key, indexfile string, hos
 		Addr:    listen,
 		Handler: r,
 	}
-	go srv.ListenAndServe()
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Error("api listener", "err", err)
+		}
+	}()
 	for ctx.Err() == nil {
 		// do nothing
 		select {
@@ -0,0 +1,365 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gabstv/sandpiper/api"
+	"github.com/gabstv/sandpiper/pkg/certmonitor"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// certificate sources; the store ids of the certificates that are not
+// loaded from files are prefixed with "<source>:"
+const (
+	certSourceFile     = "file"
+	certSourceAutocert = "autocert"
+	certSourceACMEDNS  = "acme-dns"
+	certSourceDev      = "dev"
+	certSourceUpload   = "upload"
+)
+
+// certOpTimeout limits the API certificate operations that talk to the
+// ACME server
+const certOpTimeout = time.Minute * 5
+
+func certSource(id string) string {
+	if i := strings.IndexByte(id, ':'); i > 0 {
+		switch id[:i] {
+		case certSourceACMEDNS, certSourceDev, certSourceUpload:
+			return id[:i]
+		}
+	}
+	return certSourceFile
+}
+
+// Certificates lists the certificates in the store and the autocert
+// certificates cached for the autocert routes.
+func (s *sServer) Certificates() ([]api.Certificate, error) {
+	if s.certs == nil {
+		return nil, errors.New("certificates are not loaded")
+	}
+	list := make([]api.Certificate, 0)
+	for id, cert := range s.certs.Certificates() {
+		list = append(list, describeCert(id, certSource(id), cert))
+	}
+	ctx := context.Background()
+	for domain := range s.autocertDomains {
+		for _, key := range autocertKeys(domain) {
+			if cert, err := s.cachedAutocert(ctx, key); err == nil {
+				list = append(list, describeCert(key, certSourceAutocert, cert))
+			}
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list, nil
+}
+
+// RenewCertificate obtains a new certificate of an ACME (or dev) domain.
+// Failures are reported by the certificate monitor.
+func (s *sServer) RenewCertificate(domain string) error {
+	if s.certs == nil {
+		return errors.New("certificates are not loaded")
+	}
+	source, err := s.renewCertificate(domain)
+	if err != nil {
+		if source != "" {
+			s.certMonitor.RenewalFailed(domain, source, err)
+		}
+		return err
+	}
+	s.certMonitor.Renewed(domain)
+	return nil
+}
+
+// renewCertificate returns the source of the certificate of domain (empty
+// if it can't be renewed) and the renewal error
+func (s *sServer) renewCertificate(domain string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), certOpTimeout)
+	defer cancel()
+	switch {
+	case s.isACMEDNS(domain):
+		cert, err := s.acmeDNS.Obtain(ctx, domain)
+		if err != nil {
+			return certSourceACMEDNS, err
+		}
+		s.certs.Set(certSourceACMEDNS+":"+domain, cert)
+		s.metrics.setCertificate(domain, certSourceACMEDNS, cert)
+		return certSourceACMEDNS, nil
+	case s.Cfg.LetsEncryptURL == "dev":
+		name, err := s.devCertificateName(domain)
+		if err != nil {
+			return "", err
+		}
+		s.certs.Remove(certSourceDev + ":" + name)
+		_, err = s.devCertificate(name)
+		return certSourceDev, err
+	case s.autocertHostPolicy(ctx, domain) == nil:
+		if err := s.deleteAutocert(ctx, domain); err != nil {
+			return certSourceAutocert, err
+		}
+		cert, err := s.autocertManager().GetCertificate(&tls.ClientHelloInfo{
+			ServerName:       domain,
+			CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			SupportedCurves:  []tls.CurveID{tls.CurveP256},
+			SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		})
+		if err != nil {
+			s.metrics.autocertFailures.Inc(domain)
+			return certSourceAutocert, err
+		}
+		s.metrics.setCertificate(domain, certSourceAutocert, cert)
+		return certSourceAutocert, nil
+	}
+	return "", errors.Errorf("the certificate of %v is not managed by acme", domain)
+}
+
+// RevokeCertificate revokes the ACME certificate of domain and removes it.
+// Autocert domains get a new certificate on the next handshake; acme-dns
+// domains on the next renewal.
+func (s *sServer) RevokeCertificate(domain string) error {
+	if s.certs == nil {
+		return errors.New("certificates are not loaded")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), certOpTimeout)
+	defer cancel()
+	if s.isACMEDNS(domain) {
+		id := certSourceACMEDNS + ":" + domain
+		cert := s.certs.Get(id)
+		if cert == nil {
+			return errors.Errorf("no certificate for %v", domain)
+		}
+		if err := s.acmeDNS.Revoke(ctx, domain, cert); err != nil {
+			return err
+		}
+		s.certs.Remove(id)
+		return nil
+	}
+	if s.Cfg.LetsEncryptURL == "dev" {
+		return errors.New("dev certificates can't be revoked")
+	}
+	revoked := false
+	for _, key := range autocertKeys(domain) {
+		cert, err := s.cachedAutocert(ctx, key)
+		if err != nil {
+			continue
+		}
+		signer, ok := cert.PrivateKey.(crypto.Signer)
+		if !ok {
+			return errors.Errorf("invalid private key of %v", key)
+		}
+		client := &acme.Client{DirectoryURL: s.Cfg.LetsEncryptURL}
+		if err := client.RevokeCert(ctx, signer, cert.Certificate[0], acme.CRLReasonUnspecified); err != nil {
+			return errors.Wrap(err, "revoke certificate")
+		}
+		revoked = true
+	}
+	if !revoked {
+		return errors.Errorf("no autocert certificate for %v", domain)
+	}
+	return s.deleteAutocert(ctx, domain)
+}
+
+// PutCertificate serves a PEM certificate pair for domain (until it is
+// deleted or the server restarts).
+func (s *sServer) PutCertificate(domain string, certPEM, keyPEM []byte) error {
+	if s.certs == nil {
+		return errors.New("certificates are not loaded")
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return errors.Wrap(err, "invalid certificate pair")
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return err
+	}
+	if err := cert.Leaf.VerifyHostname(domain); err != nil {
+		return err
+	}
+	s.certs.Set(certSourceUpload+":"+domain, &cert)
+	s.metrics.setCertificate(domain, certSourceUpload, &cert)
+	return nil
+}
+
+// DeleteCertificate removes the uploaded certificate and the cached
+// autocert certificates of domain.
+func (s *sServer) DeleteCertificate(domain string) error {
+	if s.certs == nil {
+		return errors.New("certificates are not loaded")
+	}
+	ctx := context.Background()
+	found := s.certs.Remove(certSourceUpload + ":" + domain)
+	for _, key := range autocertKeys(domain) {
+		if _, err := s.certCache.Get(ctx, key); err == nil {
+			found = true
+		}
+	}
+	if !found {
+		return errors.Errorf("no uploaded or cached certificate for %v", domain)
+	}
+	return s.deleteAutocert(ctx, domain)
+}
+
+// DevCA returns the PEM root certificate of the dev mode.
+func (s *sServer) DevCA() ([]byte, error) {
+	if s.devCA == nil {
+		return nil, errors.New("the dev ca is only available with LetsEncryptURL: dev")
+	}
+	return s.devCA.certPEM, nil
+}
+
+// devCertificate returns the dev certificate of the route of host,
+// issuing it on the first request
+func (s *sServer) devCertificate(host string) (*tls.Certificate, error) {
+	ca := s.devCA
+	if ca == nil {
+		return nil, errors.New("dev ca is not loaded")
+	}
+	name, err := s.devCertificateName(host)
+	if err != nil {
+		return nil, err
+	}
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	id := certSourceDev + ":" + name
+	if cert := s.certs.Get(id); cert != nil {
+		return cert, nil
+	}
+	cert, err := ca.issue(name)
+	if err != nil {
+		return nil, err
+	}
+	s.certs.Set(id, cert)
+	s.metrics.setCertificate(name, certSourceDev, cert)
+	return cert, nil
+}
+
+// devCertificateName returns the name of the dev certificate of host: the
+// domain of its route (a wildcard route gets a wildcard certificate) or the
+// API domain. The server names are client controlled, so the other hosts
+// get no certificate.
+func (s *sServer) devCertificateName(host string) (string, error) {
+	if host != "" && strings.EqualFold(host, s.Cfg.APIDomain) {
+		return s.Cfg.APIDomain, nil
+	}
+	res := s.trieDomains.Find(host)
+	if host == "" || res == nil || res.EndRoute == nil {
+		return "", errors.Errorf("no route for server name %q", host)
+	}
+	domain := res.EndRoute.Domain
+	if strings.Contains(strings.TrimPrefix(domain, "*."), "*") {
+		return "", errors.Errorf("route %v: dev certificates only support a leading wildcard", domain)
+	}
+	return domain, nil
+}
+
+// CertificateAlerts returns the open alerts of the certificate monitor.
+func (s *sServer) CertificateAlerts() []certmonitor.Alert {
+	return s.certMonitor.Alerts()
+}
+
+// setupCertMonitor creates the monitor of the listed certificates
+func (s *sServer) setupCertMonitor() {
+	cfg := certmonitor.Config{}
+	if s.Cfg.CertMonitor != nil {
+		cfg = *s.Cfg.CertMonitor
+	}
+	s.certMonitor = certmonitor.New(cfg, func() []certmonitor.Certificate {
+		list, err := s.Certificates()
+		if err != nil {
+			return nil
+		}
+		certs := make([]certmonitor.Certificate, 0, len(list))
+		for _, v := range list {
+			certs = append(certs, certmonitor.Certificate{
+				ID:       v.ID,
+				Source:   v.Source,
+				DNSNames: v.DNSNames,
+				NotAfter: v.NotAfter,
+			})
+		}
+		return certs
+	})
+	s.certMonitor.Logger = s.tlsLogger()
+}
+
+func (s *sServer) isACMEDNS(domain string) bool {
+	rt, ok := s.domains[domain]
+	return ok && rt.AutocertDNS && s.acmeDNS != nil
+}
+
+// deleteAutocert removes the cached autocert certificates of domain and
+// replaces the autocert manager, which keeps its certificates in memory
+func (s *sServer) deleteAutocert(ctx context.Context, domain string) error {
+	for _, key := range autocertKeys(domain) {
+		if err := s.certCache.Delete(ctx, key); err != nil {
+			return errors.Wrap(err, "delete cached certificate")
+		}
+	}
+	m := s.newAutocertManager()
+	s.certMu.Lock()
+	s.autocert = m
+	s.certMu.Unlock()
+	return nil
+}
+
+// autocertKeys are the cache keys of the ECDSA and RSA certificates
+func autocertKeys(domain string) []string {
+	return []string{domain, domain + "+rsa"}
+}
+
+// cachedAutocert parses a cached autocert entry (the private key followed
+// by the certificate chain)
+func (s *sServer) cachedAutocert(ctx context.Context, key string) (*tls.Certificate, error) {
+	if s.certCache == nil {
+		return nil, autocert.ErrCacheMiss
+	}
+	data, err := s.certCache.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+func describeCert(id, source string, cert *tls.Certificate) api.Certificate {
+	c := api.Certificate{
+		ID:     id,
+		Source: source,
+	}
+	switch cert.PrivateKey.(type) {
+	case *ecdsa.PrivateKey:
+		c.KeyType = "ECDSA"
+	case *rsa.PrivateKey:
+		c.KeyType = "RSA"
+	}
+	leaf := cert.Leaf
+	if leaf == nil && len(cert.Certificate) > 0 {
+		leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	}
+	if leaf != nil {
+		c.DNSNames = leaf.DNSNames
+		c.Issuer = leaf.Issuer.String()
+		c.Serial = leaf.SerialNumber.Text(16)
+		c.NotBefore = leaf.NotBefore
+		c.NotAfter = leaf.NotAfter
+	}
+	return c
+}
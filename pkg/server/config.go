@@ -1,5 +1,21 @@
 package server
 
+import (
+	"log/slog"
+	"time"
+
+	"github.com/gabstv/sandpiper/internal/pkg/route"
+	"github.com/gabstv/sandpiper/pkg/accesslog"
+	"github.com/gabstv/sandpiper/pkg/acmedns"
+	"github.com/gabstv/sandpiper/pkg/certmonitor"
+	"github.com/gabstv/sandpiper/pkg/errorpage"
+	"github.com/gabstv/sandpiper/pkg/logging"
+	"github.com/gabstv/sandpiper/pkg/ratelimit"
+	"github.com/gabstv/sandpiper/pkg/tlspolicy"
+	"github.com/gabstv/sandpiper/pkg/tracing"
+	"github.com/gabstv/sandpiper/pkg/util"
+)
+
 // Config contains the root configuration of a sandpiper server
 type Config struct {
 	Debug bool
@@ -32,4 +48,79 @@ type Config struct {
 	S3Folder string
 	//
 	AutocertAll bool
+	// Allow and Deny are global lists of CIDRs (or IPs) checked against
+	// the client address before any route is evaluated.
+	Allow []string
+	Deny  []string
+	// DenyStatus is the http status of denied requests (default 403)
+	DenyStatus int
+	// TrustedProxies are the networks allowed to set X-Forwarded-For
+	// and to send PROXY protocol headers.
+	TrustedProxies []string
+	// ProxyProtocol enables the PROXY protocol on both listeners
+	ProxyProtocol bool
+	// APIAllow restricts the API listener and the APIDomain route
+	APIAllow []string
+	// RateLimitStore holds the rate limiter buckets (default: in memory)
+	RateLimitStore ratelimit.Store
+	// Listener timeouts and limits (0 = no limit).
+	// ReadTimeout and WriteTimeout can be overridden per route.
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	// MaxBodyBytes is the default request body limit (0 = no limit)
+	MaxBodyBytes int64
+	// Upstream is the default transport configuration of the routes
+	Upstream route.TransportConfig
+	// AccessLog enables the access log (nil = disabled)
+	AccessLog *accesslog.Config
+	// Tracing exports spans to an OTLP collector (nil = disabled)
+	Tracing *tracing.Config
+	// RequestIDHeader is the request id header (default X-Request-ID)
+	RequestIDHeader string
+	// Certificates are extra certificate files served for the names
+	// they contain (e.g. an RSA and an ECDSA pair of the same domain)
+	Certificates []util.Certificate
+	// DefaultCertificate is served when no certificate matches the
+	// server name and the name is not handled by autocert
+	DefaultCertificate *util.Certificate
+	// ACMEDNS obtains the certificates of the AutocertDNS routes with
+	// DNS-01 challenges (nil = disabled)
+	ACMEDNS *acmedns.Config
+	// CertMonitor configures the certificate expiry alerts
+	// (nil = default window and interval, no webhook)
+	CertMonitor *certmonitor.Config
+	// TLS is the policy of the TLS listener (nil = Go defaults)
+	TLS *tlspolicy.Config
+	// DisableOCSPStapling stops fetching the OCSP responses of the
+	// certificate files
+	DisableOCSPStapling bool
+	// DisableHTTP2 negotiates HTTP/1.1 only on the TLS listener (routes
+	// can also opt out with DisableHTTP2)
+	DisableHTTP2 bool
+	// H2C accepts cleartext HTTP/2 (prior knowledge or Upgrade: h2c) on
+	// the HTTP listener, for load balancers that talk h2c to sandpiper
+	H2C bool
+	// HTTP3 serves HTTP/3 (QUIC) on the UDP port of ListenAddrTLS and
+	// advertises it with Alt-Svc
+	HTTP3 bool
+	// CertReloadInterval is how often the certificate files are checked
+	// for changes (default 1 minute, negative = disabled)
+	CertReloadInterval time.Duration
+	// Maintenance puts the whole server in maintenance mode
+	Maintenance *route.MaintenanceConfig
+	// ErrorPages configures the global error pages (routes can override it)
+	ErrorPages *errorpage.Config
+	// Log configures the server logger (ignored if LogHandler is set)
+	Log *logging.Config
+	// LogHandler lets programs embedding the server use their own handler
+	LogHandler slog.Handler
+	// TrustRequestID keeps the incoming request id if the connection comes
+	// from one of the TrustedProxies (from nobody if there are none)
+	TrustRequestID bool
+	// MetricsAllow lists the networks that can read /metrics on the API
+	// listener without the API key (default: loopback only)
+	MetricsAllow []string
 }
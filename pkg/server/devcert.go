@@ -1,75 +1,178 @@
 package server
 
 import (
-	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
-	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/pem"
-	"fmt"
-	"log"
 	"math/big"
+	"net"
 	"os"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// cache keys of the development CA
+const (
+	devCACertKey = "dev-ca+cert"
+	devCAKeyKey  = "dev-ca+key"
 )
 
-func createCert(hello *tls.ClientHelloInfo) (tls.Certificate, error) {
-	priv, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+// devCA is the local root CA of the dev mode (LetsEncryptURL: dev). It is
+// created once and kept in the certificate cache, so developers only need
+// to trust it once.
+type devCA struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+
+	mu sync.Mutex
+}
+
+// loadDevCA loads the CA from the cache or creates a new one
+func loadDevCA(ctx context.Context, cache autocert.Cache) (*devCA, error) {
+	certPEM, err := cache.Get(ctx, devCACertKey)
+	if err == nil {
+		keyPEM, err := cache.Get(ctx, devCAKeyKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "dev ca key")
+		}
+		return parseDevCA(certPEM, keyPEM)
+	}
+	if err != autocert.ErrCacheMiss {
+		return nil, errors.Wrap(err, "dev ca")
+	}
+	certPEM, keyPEM, err := newDevCA()
 	if err != nil {
-		log.Fatal(err)
-	}
-	template := x509.Certificate{
-		SerialNumber: big.NewInt(1),
-		Subject: pkix.Name{
-			Organization: []string{"Acme Co"},
-		},
-		NotBefore: time.Now(),
-		NotAfter:  time.Now().Add(time.Hour * 24 * 180),
+		return nil, err
+	}
+	if err := cache.Put(ctx, devCAKeyKey, keyPEM); err != nil {
+		return nil, errors.Wrap(err, "dev ca key")
+	}
+	if err := cache.Put(ctx, devCACertKey, certPEM); err != nil {
+		return nil, errors.Wrap(err, "dev ca")
+	}
+	return parseDevCA(certPEM, keyPEM)
+}
 
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+func newDevCA() (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+	host, _ := os.Hostname()
+	name := "sandpiper development CA"
+	if host != "" {
+		name += " (" + host + ")"
+	}
+	tpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name, Organization: []string{"sandpiper development CA"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
 		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "create dev ca")
 	}
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder}), nil
+}
 
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, publicKey(priv), priv)
+func parseDevCA(certPEM, keyPEM []byte) (*devCA, error) {
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, errors.Wrap(err, "dev ca")
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("dev ca: the key is not ECDSA")
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
 	if err != nil {
-		log.Fatalf("Failed to create certificate: %s", err)
+		return nil, errors.Wrap(err, "dev ca")
 	}
-	cert0 := &bytes.Buffer{}
-	pem.Encode(cert0, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
-	key0 := &bytes.Buffer{}
-	pem.Encode(key0, pemBlockForKey(priv))
+	if !cert.IsCA {
+		return nil, errors.New("dev ca: the certificate is not a CA")
+	}
+	return &devCA{
+		cert:    cert,
+		key:     key,
+		certPEM: certPEM,
+	}, nil
+}
 
-	return tls.X509KeyPair(cert0.Bytes(), key0.Bytes())
+// Fingerprint is the SHA-256 fingerprint of the CA certificate
+func (ca *devCA) Fingerprint() string {
+	sum := sha256.Sum256(ca.cert.Raw)
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
 }
 
-func publicKey(priv interface{}) interface{} {
-	switch k := priv.(type) {
-	case *rsa.PrivateKey:
-		return &k.PublicKey
-	case *ecdsa.PrivateKey:
-		return &k.PublicKey
-	default:
-		return nil
+// issue creates a leaf certificate of name (a host name or an IP) signed by
+// the CA; the chain includes the CA certificate
+func (ca *devCA) issue(name string) (*tls.Certificate, error) {
+	if name == "" {
+		name = "localhost"
 	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name, Organization: []string{"sandpiper development certificate"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		// clients reject leaf certificates valid for more than 825 days
+		NotAfter:    time.Now().AddDate(1, 0, 0),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		tpl.IPAddresses = []net.IP{ip}
+	} else {
+		tpl.DNSNames = []string{name}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, errors.Wrap(err, "create dev certificate")
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der, ca.cert.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
 }
 
-func pemBlockForKey(priv interface{}) *pem.Block {
-	switch k := priv.(type) {
-	case *rsa.PrivateKey:
-		return &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}
-	case *ecdsa.PrivateKey:
-		b, err := x509.MarshalECPrivateKey(k)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Unable to marshal ECDSA private key: %v", err)
-			os.Exit(2)
-		}
-		return &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}
-	default:
-		return nil
-	}
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
 }
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// http2Proto is the ALPN protocol of HTTP/2 over TLS
+const http2Proto = "h2"
+
+// withoutHTTP2 returns the ALPN protocols without h2
+func withoutHTTP2(protos []string) []string {
+	out := make([]string, 0, len(protos))
+	for _, v := range protos {
+		if v != http2Proto {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// disableHTTP2 stops net/http from serving HTTP/2 on the TLS listener
+func (s *sServer) disableHTTP2() {
+	s.htps.TLSConfig.NextProtos = withoutHTTP2(s.htps.TLSConfig.NextProtos)
+	// a non-nil map keeps net/http from configuring h2
+	s.htps.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+}
+
+// http2Disabled reports whether the route of host opted out of HTTP/2
+func (s *sServer) http2Disabled(host string) bool {
+	res := s.trieDomains.Find(host)
+	return res != nil && res.EndRoute != nil && res.EndRoute.DisableHTTP2
+}
+
+// configureHTTP2 makes the TLS listener negotiate HTTP/1.1 with the
+// clients of the routes that opted out of HTTP/2
+func (s *sServer) configureHTTP2(cfg *tls.Config) {
+	if s.Cfg.DisableHTTP2 {
+		return
+	}
+	optout := false
+	for _, v := range s.domains {
+		if v.DisableHTTP2 {
+			optout = true
+			break
+		}
+	}
+	if !optout {
+		return
+	}
+	next := cfg.GetConfigForClient
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if next != nil {
+			c, err := next(hello)
+			if c != nil || err != nil {
+				return c, err
+			}
+		}
+		if !s.http2Disabled(hello.ServerName) {
+			return nil, nil
+		}
+		// cloned per handshake to use the current session ticket keys
+		c := cfg.Clone()
+		c.GetConfigForClient = nil
+		c.NextProtos = withoutHTTP2(c.NextProtos)
+		return c, nil
+	}
+}
+
+// cleartextHandler serves h2c on the HTTP listener if enabled
+func (s *sServer) cleartextHandler(h http.Handler) http.Handler {
+	if !s.Cfg.H2C {
+		return h
+	}
+	h2ch := h2c.NewHandler(h, &http2.Server{IdleTimeout: s.Cfg.IdleTimeout})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 1 && s.http2Disabled(r.Host) {
+			// no Upgrade: h2c for the routes that opted out
+			h.ServeHTTP(w, r)
+			return
+		}
+		h2ch.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// newHTTP3Server returns the QUIC server of the UDP port of the TLS
+// listener. It uses the certificates of the TLS listener.
+func (s *sServer) newHTTP3Server() *http3.Server {
+	addr := s.Cfg.ListenAddrTLS
+	if addr == "" {
+		addr = ":https"
+	}
+	tlsc := s.htps.TLSConfig.Clone()
+	// the h3 protocol is set by the http3 package
+	tlsc.NextProtos = nil
+	return &http3.Server{
+		Addr:           addr,
+		Handler:        s,
+		TLSConfig:      tlsc,
+		MaxHeaderBytes: s.Cfg.MaxHeaderBytes,
+		// 0-RTT requests can be replayed, so they are not accepted
+		QuicConfig: &quic.Config{MaxIdleTimeout: s.Cfg.IdleTimeout},
+	}
+}
+
+// setAltSvc advertises HTTP/3 on the HTTP/1.1 and HTTP/2 responses of the
+// TLS listener (once the UDP port is open)
+func (s *sServer) setAltSvc(w http.ResponseWriter, r *http.Request) {
+	if s.h3 == nil || r.TLS == nil || r.ProtoMajor >= 3 {
+		return
+	}
+	if s.http2Disabled(r.TLS.ServerName) {
+		// routes without HTTP/2 keep their clients on HTTP/1.1
+		return
+	}
+	s.h3.SetQuicHeaders(w.Header())
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gabstv/sandpiper/internal/pkg/ipacl"
+	"github.com/gabstv/sandpiper/pkg/metrics"
+	"github.com/gabstv/sandpiper/pkg/util"
+)
+
+type serverMetrics struct {
+	registry         *metrics.Registry
+	requests         *metrics.Counter
+	duration         *metrics.Histogram
+	upstreamErrors   *metrics.Counter
+	bytesIn          *metrics.Counter
+	bytesOut         *metrics.Counter
+	certExpiry       *metrics.Gauge
+	autocertFailures *metrics.Counter
+	mirrorRequests   *metrics.Counter
+	mirrorDuration   *metrics.Histogram
+
+	certsMu sync.Mutex
+	certs   map[string]*tls.Certificate
+}
+
+func newServerMetrics(s *sServer) *serverMetrics {
+	r := metrics.NewRegistry()
+	m := &serverMetrics{
+		registry: r,
+		requests: r.NewCounter("sandpiper_requests_total",
+			"Requests by route and status class.", "route", "code"),
+		duration: r.NewHistogram("sandpiper_request_duration_seconds",
+			"Request latency by route.", nil, "route"),
+		upstreamErrors: r.NewCounter("sandpiper_upstream_errors_total",
+			"Failed upstream round trips by route.", "route"),
+		bytesIn: r.NewCounter("sandpiper_request_bytes_total",
+			"Request body bytes received by route.", "route"),
+		bytesOut: r.NewCounter("sandpiper_response_bytes_total",
+			"Response body bytes sent by route.", "route"),
+		certExpiry: r.NewGauge("sandpiper_certificate_expiry_timestamp_seconds",
+			"NotAfter of the served certificates.", "domain", "source"),
+		autocertFailures: r.NewCounter("sandpiper_autocert_failures_total",
+			"Failed autocert certificate requests by domain.", "domain"),
+		mirrorRequests: r.NewCounter("sandpiper_mirror_requests_total",
+			"Shadow requests by route and status class.", "route", "code"),
+		mirrorDuration: r.NewHistogram("sandpiper_mirror_duration_seconds",
+			"Shadow request latency by route.", nil, "route"),
+		certs: make(map[string]*tls.Certificate),
+	}
+	r.NewGaugeFunc("sandpiper_websocket_bridges_active", "Open websocket bridges.", func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(util.ActiveWebsockets())}}
+	})
+	r.NewGaugeFunc("sandpiper_loadbalancer_target_health", "Passive health score of the load balancer targets (below 50 they are skipped).", func() []metrics.Sample {
+		samples := make([]metrics.Sample, 0)
+		for domain, rt := range s.Routes() {
+			for target, score := range rt.TargetHealth() {
+				samples = append(samples, metrics.Sample{
+					LabelValues: []string{domain, target},
+					Value:       float64(score),
+				})
+			}
+		}
+		return samples
+	}, "route", "target")
+	r.NewGaugeFunc("sandpiper_certificate_alerts", "Open certificate alerts (expiring, expired, renewal_failed).", func() []metrics.Sample {
+		samples := make([]metrics.Sample, 0)
+		for _, a := range s.CertificateAlerts() {
+			samples = append(samples, metrics.Sample{
+				LabelValues: []string{a.ID, a.Kind},
+				Value:       1,
+			})
+		}
+		return samples
+	}, "id", "kind")
+	r.NewCounterFunc("sandpiper_tracing_spans_dropped_total", "Spans dropped because the export queue was full.", func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(s.tracer.Dropped())}}
+	})
+	return m
+}
+
+func (m *serverMetrics) observe(w *util.ResponseWriter, info *util.RequestInfo, bytesIn int64, d time.Duration) {
+	rt := info.Route
+	if rt == "" {
+		rt = "-"
+	}
+	status := w.Status
+	if status == 0 {
+		status = 200
+	}
+	m.requests.Inc(rt, strconv.Itoa(status/100)+"xx")
+	m.duration.Observe(d.Seconds(), rt)
+	m.bytesIn.Add(float64(bytesIn), rt)
+	m.bytesOut.Add(float64(w.Bytes), rt)
+	if info.UpstreamError != nil {
+		m.upstreamErrors.Inc(rt)
+	}
+}
+
+// observeMirror records the result of a shadow request.
+// Failed requests are counted with the "error" code.
+func (m *serverMetrics) observeMirror(rt string, status int, d time.Duration) {
+	code := "error"
+	if status > 0 {
+		code = strconv.Itoa(status/100) + "xx"
+	}
+	m.mirrorRequests.Inc(rt, code)
+	m.mirrorDuration.Observe(d.Seconds(), rt)
+}
+
+// setCertificate records the expiry of a served certificate
+func (m *serverMetrics) setCertificate(domain, source string, cert *tls.Certificate) {
+	m.certsMu.Lock()
+	defer m.certsMu.Unlock()
+	if m.certs[domain] == cert {
+		return
+	}
+	m.certs[domain] = cert
+	leaf := cert.Leaf
+	if leaf == nil && len(cert.Certificate) > 0 {
+		leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	}
+	if leaf != nil {
+		m.certExpiry.Set(float64(leaf.NotAfter.Unix()), domain, source)
+	}
+}
+
+// countingReader counts the bytes read from a request body
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// metricsHandler serves the metrics to the allowed networks and to the
+// requests with the API key. The client address is resolved like the
+// APIAllow one, so the requests of the APIDomain route (from loopback)
+// are checked against the forwarded client.
+func (s *sServer) metricsHandler(allow []*net.IPNet) http.Handler {
+	loopback, _ := ipacl.ParseNets([]string{"127.0.0.0/8", "::1"})
+	trusted := append(loopback, s.trustedProxies...)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("X-API-KEY")
+		if s.Cfg.APIKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(s.Cfg.APIKey)) == 1 {
+			s.metrics.registry.ServeHTTP(w, r)
+			return
+		}
+		if ip := ipacl.ClientIP(r, trusted); ip == nil || !ipacl.Contains(allow, ip) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		s.metrics.registry.ServeHTTP(w, r)
+	})
+}
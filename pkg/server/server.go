@@ -2,18 +2,38 @@ package server
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/hex"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"runtime"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/armon/go-proxyproto"
+	"github.com/gabstv/sandpiper/api"
+	"github.com/gabstv/sandpiper/internal/pkg/ipacl"
 	"github.com/gabstv/sandpiper/internal/pkg/pathtree"
 	"github.com/gabstv/sandpiper/internal/pkg/route"
+	"github.com/gabstv/sandpiper/pkg/accesslog"
+	"github.com/gabstv/sandpiper/pkg/acmedns"
+	"github.com/gabstv/sandpiper/pkg/certmonitor"
+	"github.com/gabstv/sandpiper/pkg/certstore"
+	"github.com/gabstv/sandpiper/pkg/errorpage"
+	"github.com/gabstv/sandpiper/pkg/logging"
+	"github.com/gabstv/sandpiper/pkg/ocspstaple"
+	"github.com/gabstv/sandpiper/pkg/ratelimit"
 	"github.com/gabstv/sandpiper/pkg/s3dircache"
+	"github.com/gabstv/sandpiper/pkg/tlspolicy"
+	"github.com/gabstv/sandpiper/pkg/tracing"
 	"github.com/gabstv/sandpiper/pkg/util"
 	"github.com/pkg/errors"
+	"github.com/quic-go/quic-go/http3"
 	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
 )
@@ -28,16 +48,55 @@ type Server interface {
 	Routes() map[string]route.Route
 	GetConfig() Config
 	SetConfig(cfg Config)
+	// SetMaintenance changes the maintenance mode of a route
+	// (or of the whole server if domain is empty)
+	SetMaintenance(domain string, cfg route.MaintenanceConfig) error
+	Maintenance(domain string) (route.MaintenanceConfig, error)
+	// SetSplitWeights changes the upstream group weights of a SPLIT route
+	SetSplitWeights(domain string, weights map[string]int) error
+	SplitWeights(domain string) (map[string]int, error)
+	// Certificates lists the certificates held by the server
+	Certificates() ([]api.Certificate, error)
+	// RenewCertificate obtains a new ACME certificate for domain
+	RenewCertificate(domain string) error
+	// RevokeCertificate revokes and removes the ACME certificate of domain
+	RevokeCertificate(domain string) error
+	// PutCertificate serves a PEM certificate pair for domain
+	PutCertificate(domain string, certPEM, keyPEM []byte) error
+	// DeleteCertificate removes the uploaded and the cached autocert
+	// certificates of domain
+	DeleteCertificate(domain string) error
+	// CertificateAlerts returns the expiring certificates and the
+	// failed renewals
+	CertificateAlerts() []certmonitor.Alert
+	// DevCA returns the PEM root certificate of the dev mode
+	DevCA() ([]byte, error)
 }
 
 type sServer struct {
 	Cfg             Config
 	trieDomains     *pathtree.Trie
 	domains         map[string]*route.Route
-	Logger          *log.Logger
+	Logger          *slog.Logger
+	rootLogger      *slog.Logger
 	closeChan       chan os.Signal
 	htps            *http.Server
+	h3              *http3.Server
 	autocertDomains map[string]bool
+	acl             *ipacl.ACL
+	trustedProxies  []*net.IPNet
+	accessLog       *accesslog.Logger
+	metrics         *serverMetrics
+	tracer          *tracing.Tracer
+	errorPages      *errorpage.Pages
+	maintenance     *route.Maintenance
+	certs           *certstore.Store
+	certCache       autocert.Cache
+	certMu          sync.Mutex
+	autocert        *autocert.Manager
+	acmeDNS         *acmedns.Manager
+	certMonitor     *certmonitor.Monitor
+	devCA           *devCA
 }
 
 func (s *sServer) GetConfig() Config {
@@ -46,6 +105,62 @@ func (s *sServer) GetConfig() Config {
 
 func (s *sServer) SetConfig(cfg Config) {
 	s.Cfg = cfg
+	if err := s.setupAccess(); err != nil {
+		s.Logger.Error("access list", "err", err)
+	}
+}
+
+func (s *sServer) SetMaintenance(domain string, cfg route.MaintenanceConfig) error {
+	if domain == "" {
+		return s.maintenance.Set(cfg)
+	}
+	rt, ok := s.domains[domain]
+	if !ok {
+		return errors.Errorf("domain %v does not exist", domain)
+	}
+	return rt.SetMaintenance(cfg)
+}
+
+func (s *sServer) Maintenance(domain string) (route.MaintenanceConfig, error) {
+	if domain == "" {
+		return s.maintenance.Config(), nil
+	}
+	rt, ok := s.domains[domain]
+	if !ok {
+		return route.MaintenanceConfig{}, errors.Errorf("domain %v does not exist", domain)
+	}
+	return rt.MaintenanceConfig(), nil
+}
+
+func (s *sServer) SetSplitWeights(domain string, weights map[string]int) error {
+	rt, ok := s.domains[domain]
+	if !ok {
+		return errors.Errorf("domain %v does not exist", domain)
+	}
+	return rt.SetSplitWeights(weights)
+}
+
+func (s *sServer) SplitWeights(domain string) (map[string]int, error) {
+	rt, ok := s.domains[domain]
+	if !ok {
+		return nil, errors.Errorf("domain %v does not exist", domain)
+	}
+	return rt.SplitWeights(), nil
+}
+
+// setupAccess parses the global allow/deny lists and the trusted proxies
+func (s *sServer) setupAccess() error {
+	acl, err := ipacl.New(s.Cfg.Allow, s.Cfg.Deny)
+	if err != nil {
+		return errors.Wrap(err, "allow/deny")
+	}
+	trusted, err := ipacl.ParseNets(s.Cfg.TrustedProxies)
+	if err != nil {
+		return errors.Wrap(err, "trusted proxies")
+	}
+	s.acl = acl
+	s.trustedProxies = trusted
+	return nil
 }
 
 // Default starts a server with the default configuration options
@@ -56,8 +171,48 @@ func Default(cfg *Config) Server {
 	}
 	s.trieDomains = pathtree.NewTrie(".")
 	s.domains = make(map[string]*route.Route, 0)
-	s.Logger = log.New(os.Stderr, "[sp server] ", log.LstdFlags)
+	s.rootLogger = s.newLogger()
+	s.Logger = s.rootLogger.With("subsystem", "server")
 	s.autocertDomains = make(map[string]bool)
+	s.metrics = newServerMetrics(s)
+	s.setupCertMonitor()
+	if err := s.setupAccess(); err != nil {
+		s.Logger.Error("access list", "err", err)
+	}
+	if s.Cfg.Tracing != nil {
+		tcfg := *s.Cfg.Tracing
+		if tcfg.Logger == nil {
+			tcfg.Logger = s.rootLogger.With("subsystem", "tracing")
+		}
+		t, err := tracing.New(tcfg)
+		if err != nil {
+			s.Logger.Error("tracing", "err", err)
+		} else {
+			s.tracer = t
+		}
+	}
+	if s.Cfg.ErrorPages != nil {
+		p, err := errorpage.New(*s.Cfg.ErrorPages)
+		if err != nil {
+			s.Logger.Error("error pages", "err", err)
+		} else {
+			s.errorPages = p
+		}
+	}
+	m, err := route.NewMaintenance(s.Cfg.Maintenance)
+	if err != nil {
+		s.Logger.Error("maintenance", "err", err)
+		m, _ = route.NewMaintenance(nil)
+	}
+	s.maintenance = m
+	if s.Cfg.AccessLog != nil {
+		l, err := accesslog.New(*s.Cfg.AccessLog)
+		if err != nil {
+			s.Logger.Error("access log", "err", err)
+		} else {
+			s.accessLog = l
+		}
+	}
 	return s
 }
 
@@ -73,11 +228,24 @@ func (s *sServer) startAPI(ctx context.Context) error {
 	if s.Cfg.APIListen == "" {
 		return nil
 	}
-	go runAPIV1(ctx, s, s.Cfg.APIListen, s.Cfg.APIKey, s.Cfg.APIIndexFile, s.Cfg.APIHostFolders, s.Cfg.Debug)
+	apiacl, err := ipacl.New(s.Cfg.APIAllow, nil)
+	if err != nil {
+		return errors.Wrap(err, "api allow")
+	}
+	metricsAllow := s.Cfg.MetricsAllow
+	if len(metricsAllow) == 0 {
+		metricsAllow = []string{"127.0.0.0/8", "::1"}
+	}
+	metricsNets, err := ipacl.ParseNets(metricsAllow)
+	if err != nil {
+		return errors.Wrap(err, "metrics allow")
+	}
+	go runAPIV1(ctx, s, s.Cfg.APIListen, s.Cfg.APIKey, s.Cfg.APIIndexFile, s.Cfg.APIHostFolders, s.Cfg.Debug, apiacl, s.trustedProxies, s.metricsHandler(metricsNets), s.rootLogger.With("subsystem", "api"))
 	if s.Cfg.APIDomain != "" {
-		s.Add(route.Route{
+		return s.Add(route.Route{
 			Autocert: s.Cfg.APIDomainAutocert,
 			Domain:   s.Cfg.APIDomain,
+			Allow:    s.Cfg.APIAllow,
 			Server: route.RouteServer{
 				OutAddress:  s.Cfg.APIListen,
 				OutConnType: route.HTTP,
@@ -95,9 +263,41 @@ func (s *sServer) Add(r route.Route) error {
 	*rr = r
 
 	rr.SetupWsCfgDefaults()
-
-	err := s.trieDomains.Add(r.Domain, rr)
+	rr.SetLogger(s.rootLogger.With("subsystem", "proxy", "route", r.Domain))
+	if err := rr.SetupErrorPages(s.errorPages); err != nil {
+		return errors.Wrapf(err, "route %v", r.Domain)
+	}
+	if err := rr.SetupMaintenance(); err != nil {
+		return errors.Wrapf(err, "route %v", r.Domain)
+	}
+	if err := rr.SetupACL(); err != nil {
+		return errors.Wrapf(err, "route %v", r.Domain)
+	}
+	rr.SetupLimits(s.Cfg.RateLimitStore)
+	if err := rr.SetupTransport(s.Cfg.Upstream); err != nil {
+		return errors.Wrapf(err, "route %v upstream", r.Domain)
+	}
+	mlog := s.rootLogger.With("subsystem", "mirror", "route", r.Domain)
+	err := rr.SetupMirror(func(status int, latency time.Duration, err error) {
+		s.metrics.observeMirror(r.Domain, status, latency)
+		if err != nil {
+			mlog.Debug("shadow request", "err", err)
+		}
+	})
 	if err != nil {
+		return errors.Wrapf(err, "route %v", r.Domain)
+	}
+	if err := rr.SetupSplit(); err != nil {
+		return errors.Wrapf(err, "route %v", r.Domain)
+	}
+	if err := rr.SetupLoadBalancer(); err != nil {
+		return errors.Wrapf(err, "route %v", r.Domain)
+	}
+	if err := rr.SetupRules(); err != nil {
+		return errors.Wrapf(err, "route %v", r.Domain)
+	}
+
+	if err := s.trieDomains.Add(r.Domain, rr); err != nil {
 		return err
 	}
 	s.domains[r.Domain] = rr
@@ -112,12 +312,21 @@ func (s *sServer) autocertHostPolicy(ctx context.Context, host string) error {
 		return nil
 	}
 	if s.Cfg.AutocertAll {
-		s.Logger.Println("autocertHostPolicy AutocertAll:", host)
+		s.tlsLogger().Debug("autocert host allowed (autocert_all)", "host", host)
 		return nil
 	}
 	return fmt.Errorf("acme/autocert: host %s NOT allowed", host)
 }
 
+// autocertMetricDomain is the metric label of host: the SNI is client
+// controlled, so the hosts that are not autocert routes are "other"
+func (s *sServer) autocertMetricDomain(host string) string {
+	if s.autocertDomains[host] {
+		return host
+	}
+	return "other"
+}
+
 func (s *sServer) setupCertificates() *autocert.Manager {
 	var m *autocert.Manager
 	cpath := "/tmp/sandpiper"
@@ -138,117 +347,290 @@ func (s *sServer) setupCertificates() *autocert.Manager {
 		dcache = &dc
 	}
 
-	webmail := os.Getenv("AUTOCERT_EMAIL")
-	println("AUTOCERT_EMAIL:", webmail)
+	s.certCache = dcache
+	m = s.newAutocertManager()
+	s.certMu.Lock()
+	s.autocert = m
+	s.certMu.Unlock()
 
-	m = &autocert.Manager{
-		Prompt:     autocert.AcceptTOS,
-		HostPolicy: s.autocertHostPolicy,
-		Cache:      dcache,
-		Email:      webmail,
+	certs := certstore.New()
+	certs.Logger = s.tlsLogger()
+	certs.OnLoad = func(domain string, cert *tls.Certificate) {
+		s.metrics.setCertificate(domain, "file", cert)
 	}
-	if s.Cfg.LetsEncryptURL != "" {
-		m.Client = &acme.Client{DirectoryURL: s.Cfg.LetsEncryptURL}
+	if !s.Cfg.DisableOCSPStapling {
+		certs.OCSP = &ocspstaple.Fetcher{}
 	}
-
-	certs := make(map[string]tls.Certificate)
 	for k, v := range s.domains {
 		if !v.Autocert && len(v.Certificate.KeyFile) > 0 && len(v.Certificate.CertFile) > 0 {
-			ncert, err := tls.LoadX509KeyPair(v.Certificate.CertFile, v.Certificate.KeyFile)
-			if err != nil {
-				s.Logger.Println("Error loading certificate for", k, err.Error())
-			} else {
-				certs[k] = ncert
+			if err := certs.AddFile(k, v.Certificate.CertFile, v.Certificate.KeyFile); err != nil {
+				s.tlsLogger().Error("loading certificate", "domain", k, "err", err)
 			}
 		}
 	}
+	for _, v := range s.Cfg.Certificates {
+		if err := certs.AddFile(v.CertFile, v.CertFile, v.KeyFile); err != nil {
+			s.tlsLogger().Error("loading certificate", "file", v.CertFile, "err", err)
+		}
+	}
+	if v := s.Cfg.DefaultCertificate; v != nil {
+		if err := certs.AddFile("default", v.CertFile, v.KeyFile); err != nil {
+			s.tlsLogger().Error("loading default certificate", "file", v.CertFile, "err", err)
+		}
+		certs.SetDefault("default")
+	}
+	s.certs = certs
 
 	getcertfn := func(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
-		s.Logger.Println("get certificate", *clientHello)
-		if dom, ok := certs[clientHello.ServerName]; ok {
-			return &dom, nil
+		s.tlsLogger().Debug("get certificate", "server_name", clientHello.ServerName)
+		if cert := certs.Match(clientHello); cert != nil {
+			return cert, nil
 		}
-		return m.GetCertificate(clientHello)
+		if def := certs.Default(); def != nil && s.autocertHostPolicy(clientHello.Context(), clientHello.ServerName) != nil {
+			return def, nil
+		}
+		cert, err := s.autocertManager().GetCertificate(clientHello)
+		if err != nil {
+			s.metrics.autocertFailures.Inc(s.autocertMetricDomain(clientHello.ServerName))
+			// with autocert_all any client can pick the server name, so only
+			// the autocert routes raise alerts
+			if s.autocertDomains[clientHello.ServerName] {
+				s.certMonitor.RenewalFailed(clientHello.ServerName, certSourceAutocert, err)
+			}
+			return nil, err
+		}
+		s.certMonitor.Renewed(clientHello.ServerName)
+		s.metrics.setCertificate(clientHello.ServerName, "autocert", cert)
+		return cert, nil
 	}
 	if s.Cfg.LetsEncryptURL == "dev" {
+		if ca, err := loadDevCA(context.Background(), dcache); err != nil {
+			s.tlsLogger().Error("dev ca", "err", err)
+		} else {
+			s.devCA = ca
+			s.tlsLogger().Info("dev ca (trust it with GET /v1/certificates/dev-ca)",
+				"subject", ca.cert.Subject.CommonName, "sha256", ca.Fingerprint())
+		}
 		getcertfn = func(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
-			s.Logger.Println("get certificate (dev)", *clientHello)
-			if dom, ok := certs[clientHello.ServerName]; ok {
-				return &dom, nil
+			s.tlsLogger().Debug("get certificate (dev)", "server_name", clientHello.ServerName)
+			if cert := certs.Match(clientHello); cert != nil {
+				return cert, nil
 			}
-			cccert, err := createCert(clientHello)
-			if err != nil {
-				return nil, err
-			}
-			certs[clientHello.ServerName] = cccert
-			return &cccert, nil
+			return s.devCertificate(clientHello.ServerName)
 		}
 	}
 	if s.htps != nil {
 		s.htps.TLSConfig = m.TLSConfig() //&tls.Config{GetCertificate: getcertfn}
 		s.htps.TLSConfig.GetCertificate = getcertfn
 	} else {
-		s.Logger.Println("s.htps WAS NIL")
-		s.htps = &http.Server{
-			Addr: s.Cfg.ListenAddrTLS,
-		}
-		s.htps.Handler = s
+		s.htps = s.newHTTPServer(s.Cfg.ListenAddrTLS, s)
 		s.htps.TLSConfig = m.TLSConfig() //&tls.Config{GetCertificate: getcertfn}
 		s.htps.TLSConfig.GetCertificate = getcertfn
 	}
+	if s.Cfg.TLS != nil {
+		// validated by Run
+		if err := s.Cfg.TLS.Apply(s.htps.TLSConfig); err != nil {
+			s.tlsLogger().Error("tls policy", "err", err)
+		}
+	}
+	if s.Cfg.DisableHTTP2 {
+		s.disableHTTP2()
+	}
 	return m
 }
 
+// startACMEDNS obtains and renews the certificates of the AutocertDNS
+// routes in the background
+func (s *sServer) startACMEDNS(ctx context.Context) error {
+	if s.Cfg.ACMEDNS == nil {
+		return nil
+	}
+	domains := make([]string, 0)
+	for k, v := range s.domains {
+		if v.AutocertDNS {
+			domains = append(domains, k)
+		}
+	}
+	if len(domains) == 0 {
+		return nil
+	}
+	cfg := *s.Cfg.ACMEDNS
+	if cfg.DirectoryURL == "" && s.Cfg.LetsEncryptURL != "dev" {
+		cfg.DirectoryURL = s.Cfg.LetsEncryptURL
+	}
+	m, err := acmedns.NewManager(cfg, s.certCache)
+	if err != nil {
+		return err
+	}
+	m.Logger = s.tlsLogger()
+	m.OnError = func(domain string, err error) {
+		s.certMonitor.RenewalFailed(domain, certSourceACMEDNS, err)
+	}
+	s.acmeDNS = m
+	go m.Run(ctx, domains, func(domain string, cert *tls.Certificate) {
+		s.certs.Set(certSourceACMEDNS+":"+domain, cert)
+		s.metrics.setCertificate(domain, certSourceACMEDNS, cert)
+		s.certMonitor.Renewed(domain)
+	})
+	return nil
+}
+
+// newAutocertManager creates the autocert manager of the certificate cache
+func (s *sServer) newAutocertManager() *autocert.Manager {
+	webmail := os.Getenv("AUTOCERT_EMAIL")
+	s.tlsLogger().Debug("autocert", "email", webmail)
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: s.autocertHostPolicy,
+		Cache:      s.certCache,
+		Email:      webmail,
+	}
+	if s.Cfg.LetsEncryptURL != "" {
+		m.Client = &acme.Client{DirectoryURL: s.Cfg.LetsEncryptURL}
+	}
+	return m
+}
+
+func (s *sServer) autocertManager() *autocert.Manager {
+	s.certMu.Lock()
+	defer s.certMu.Unlock()
+	return s.autocert
+}
+
+// certReloadInterval is the polling interval of the certificate files
+// (default 1 minute, negative = disabled)
+func (s *sServer) certReloadInterval() time.Duration {
+	if s.Cfg.CertReloadInterval == 0 {
+		return time.Minute
+	}
+	return s.Cfg.CertReloadInterval
+}
+
+// listenAndServe is http.ListenAndServe with optional PROXY protocol support
+func (s *sServer) listenAndServe(addr string, handler http.Handler) error {
+	if addr == "" {
+		addr = ":http"
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.newHTTPServer(addr, handler).Serve(s.wrapListener(l))
+}
+
+// newHTTPServer returns a http.Server with the configured timeouts
+func (s *sServer) newHTTPServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: s.Cfg.ReadHeaderTimeout,
+		ReadTimeout:       s.Cfg.ReadTimeout,
+		WriteTimeout:      s.Cfg.WriteTimeout,
+		IdleTimeout:       s.Cfg.IdleTimeout,
+		MaxHeaderBytes:    s.Cfg.MaxHeaderBytes,
+	}
+}
+
+func (s *sServer) wrapListener(l net.Listener) net.Listener {
+	if !s.Cfg.ProxyProtocol {
+		return l
+	}
+	return &proxyproto.Listener{
+		Listener:           l,
+		ProxyHeaderTimeout: time.Second * 10,
+		SourceCheck: func(addr net.Addr) (bool, error) {
+			if tcpaddr, ok := addr.(*net.TCPAddr); ok {
+				return ipacl.Contains(s.trustedProxies, tcpaddr.IP), nil
+			}
+			return false, nil
+		},
+	}
+}
+
 func (s *sServer) Run() error {
 	s.Init()
-	errc := make(chan error, 3)
+	if err := s.setupAccess(); err != nil {
+		return err
+	}
+	if s.Cfg.TLS != nil {
+		if err := s.Cfg.TLS.Apply(&tls.Config{}); err != nil {
+			return errors.Wrap(err, "tls policy")
+		}
+	}
+	errc := make(chan error, 4)
 	ctx, cancelf := context.WithCancel(context.Background())
 
-	s.htps = &http.Server{
-		Addr: s.Cfg.ListenAddrTLS,
-	}
+	s.htps = s.newHTTPServer(s.Cfg.ListenAddrTLS, s)
 	autocertManager := s.setupCertificates()
 
-	s.htps.Handler = s
-
 	go func() {
 		if autocertManager == nil || s.Cfg.DisableTLS {
-			s.Logger.Println("Listening HTTP")
+			s.Logger.Info("listening http", "addr", s.Cfg.ListenAddr)
 			if autocertManager == nil {
-				s.Logger.Println("autocertManager is nil")
+				s.Logger.Debug("autocert manager is nil")
 			}
-			lserr := http.ListenAndServe(s.Cfg.ListenAddr, s)
+			lserr := s.listenAndServe(s.Cfg.ListenAddr, s.cleartextHandler(s))
 			if lserr != nil {
 				errc <- errors.Wrapf(lserr, "[default] http.ListenAndServe(%q)", s.Cfg.ListenAddr)
 			}
 		} else {
-			s.Logger.Println("Listening accepting HTTP requests to the SNI challenge")
-			lserr := http.ListenAndServe(s.Cfg.ListenAddr, autocertManager.HTTPHandler(s))
+			s.Logger.Info("listening http (acme challenges)", "addr", s.Cfg.ListenAddr)
+			lserr := s.listenAndServe(s.Cfg.ListenAddr, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// the manager is replaced when a certificate is renewed by the API
+				s.autocertManager().HTTPHandler(s).ServeHTTP(w, r)
+			}))
 			if lserr != nil {
 				errc <- errors.Wrapf(lserr, "[default] http.ListenAndServe(%q)", s.Cfg.ListenAddr)
 			}
 		}
 	}()
 
-	certs := make([]util.Certificate, 0, len(s.domains))
-	for _, v := range s.domains {
-		if v.Certificate.CertFile != "" {
-			certs = append(certs, v.Certificate)
-		}
+	// the certificate files are served (and reloaded) by s.certs
+	if interval := s.certReloadInterval(); interval > 0 {
+		go s.certs.Watch(ctx, interval)
+	}
+	if s.certs.OCSP != nil {
+		// staple before the TLS listener starts (must-staple clients
+		// reject certificates without a response)
+		s.certs.RefreshOCSP(ctx)
+		go s.certs.WatchOCSP(ctx, time.Minute)
+	}
+	if err := s.startACMEDNS(ctx); err != nil {
+		s.tlsLogger().Error("acme dns-01", "err", err)
+	}
+	go s.certMonitor.Run(ctx)
+	if s.Cfg.HTTP3 && !s.Cfg.DisableTLS {
+		s.h3 = s.newHTTP3Server()
+		go func() {
+			s.Logger.Info("listening http/3", "addr", s.h3.Addr)
+			if lserr := s.h3.ListenAndServe(); lserr != nil && lserr != http.ErrServerClosed {
+				errc <- errors.Wrapf(lserr, "http3 ListenAndServe(%q)", s.h3.Addr)
+			}
+		}()
 	}
 	var wrapper *util.ServerWrapper
 	if !s.Cfg.DisableTLS {
 		go func() {
 			if s.Cfg.Graceful {
-				//s.Logger.Println("Listening HTTPS (Graceful)")
+				//s.Logger.Info("listening https (graceful)")
 				//wrapper = util.NewGracefulServer(manners.NewWithServer(s.htps))
-				s.Logger.Println("Graceful mode disabled due to inability to resolve autocert challenges properly")
+				s.Logger.Warn("graceful mode disabled due to inability to resolve autocert challenges properly")
 			}
 			//} else {
-			s.Logger.Println("Listening HTTPS (Vanilla)")
+			s.Logger.Info("listening https", "addr", s.Cfg.ListenAddrTLS)
 			wrapper = util.NewVanillaServer(s.htps)
+			wrapper.WrapListener = s.wrapListener
+			wrapper.Logger = s.Logger
+			wrapper.ConfigureTLS = func(cfg *tls.Config) {
+				s.configureHTTP2(cfg)
+				if s.Cfg.TLS != nil && s.Cfg.TLS.SessionTicketRotation > 0 {
+					interval := time.Duration(s.Cfg.TLS.SessionTicketRotation) * time.Second
+					go tlspolicy.RotateSessionTickets(ctx, cfg, interval, s.tlsLogger())
+				}
+			}
 			//}
-			lserr := util.ListenAndServeTLSSNI(wrapper, certs)
+			lserr := util.ListenAndServeTLSSNI(wrapper, nil)
 			if lserr != nil {
 				errc <- errors.Wrap(lserr, "util.ListenAndServeTLSSNI")
 			}
@@ -257,9 +639,9 @@ func (s *sServer) Run() error {
 	//
 	// API
 	if err := s.startAPI(ctx); err != nil {
-		s.Logger.Println("START API ERROR:", err.Error())
+		s.Logger.Error("start api", "err", err)
 	}
-	s.Logger.Println("API STARTED")
+	s.Logger.Info("api started", "addr", s.Cfg.APIListen)
 	//
 	go func() {
 		s.closeChan = make(chan os.Signal, 1)
@@ -268,6 +650,10 @@ func (s *sServer) Run() error {
 		if wrapper != nil {
 			wrapper.Close()
 		}
+		if s.h3 != nil {
+			s.h3.Close()
+		}
+		s.tracer.Shutdown()
 		errc <- nil
 	}()
 	//
@@ -289,62 +675,314 @@ func (s *sServer) Init() {
 }
 
 func (s *sServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r, info := util.WithRequestInfo(r)
+	s.setRequestID(w, r, info)
+	s.setAltSvc(w, r)
+	ctx, span := s.tracer.StartServer(r, r.Method)
+	if span != nil {
+		r = r.WithContext(ctx)
+	}
+	start := time.Now()
+	lw := util.NewResponseWriter(w)
+	body := &countingReader{ReadCloser: r.Body}
+	if r.Body != nil {
+		r.Body = body
+	}
+	s.serveHTTP(lw, r)
+	if span != nil {
+		s.endServerSpan(span, lw, r, info)
+	}
+	s.metrics.observe(lw, info, body.n, time.Since(start))
+	if s.accessLog != nil {
+		s.logAccess(lw, r, info, start)
+	}
+}
+
+func (s *sServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
 	h := r.Host
 	if s.Cfg.Debug {
 		if ho := r.Header.Get("X-Sandpiper-Host"); ho != "" {
 			h = ho
 		}
-		s.Logger.Println("Host: " + h)
 	}
+	s.requestLogger(r).Debug("request", "host", h, "method", r.Method, "uri", r.RequestURI)
+	clientIP := ipacl.ClientIP(r, s.trustedProxies)
+	if info := util.GetRequestInfo(r.Context()); info != nil {
+		info.ClientIP = clientIP
+	}
+	if !s.acl.Allowed(clientIP) {
+		s.requestLogger(r).Debug("denied", "client_ip", clientIP.String())
+		s.errorPages.Write(w, r, s.denyStatus(nil), "")
+		return
+	}
+	if s.maintenance.Serve(w, r, clientIP, s.errorPages) {
+		return
+	}
+	_, span := tracing.Start(r.Context(), "route lookup", tracing.KindInternal)
 	res := s.trieDomains.Find(h)
+	span.SetAttribute("sandpiper.found", res != nil)
+	span.End()
 	if res == nil {
 		if len(s.Cfg.FallbackDomain) > 0 {
-			if s.Cfg.Debug {
-				s.Logger.Println("FALLBACK DOMAIN", s.Cfg.FallbackDomain)
-			}
+			s.requestLogger(r).Debug("fallback domain", "domain", s.Cfg.FallbackDomain)
 			dom := s.domains[s.Cfg.FallbackDomain]
 			if dom != nil {
-				if dom.AuthMode != "" {
-					switch dom.AuthMode {
-					case "apikey":
-						if dom.AuthValue != r.Header.Get(dom.AuthKey) {
-							w.WriteHeader(http.StatusUnauthorized)
-							return
-						}
-					}
-				}
-				dom.ReverseProxy(w, r)
+				s.serveRoute(w, r, dom, clientIP)
 				return
 			} else {
-				if s.Cfg.Debug {
-					s.Logger.Println("FALLBACK DOMAIN NOT FOUND")
-				}
-				http.Error(w, "fallback domain not found "+h, http.StatusInternalServerError)
+				s.requestLogger(r).Debug("fallback domain not found", "domain", s.Cfg.FallbackDomain)
+				s.errorPages.Write(w, r, http.StatusInternalServerError, "fallback domain not found "+h)
 				return
 			}
 		} else {
-			if s.Cfg.Debug {
-				s.Logger.Println("DOMAIN NOT FOUND")
-			}
-			http.Error(w, "domain not found "+h, http.StatusInternalServerError)
+			s.requestLogger(r).Debug("domain not found", "host", h)
+			s.errorPages.Write(w, r, unknownHostStatus(r, h), "domain not found "+h)
 			return
 		}
 	}
 	if res.EndRoute == nil {
-		if s.Cfg.Debug {
-			s.Logger.Println("ROUTE IS NULL")
-		}
-		http.Error(w, "route is null", http.StatusInternalServerError)
+		s.requestLogger(r).Debug("route is null", "host", h)
+		s.errorPages.Write(w, r, unknownHostStatus(r, h), "route is null")
+		return
+	}
+	s.serveRoute(w, r, res.EndRoute, clientIP)
+}
+
+// serveRoute runs the route checks and proxies the request
+func (s *sServer) serveRoute(w http.ResponseWriter, r *http.Request, rt *route.Route, clientIP net.IP) {
+	if info := util.GetRequestInfo(r.Context()); info != nil {
+		info.Route = rt.Domain
+	}
+	_, span := tracing.Start(r.Context(), "auth", tracing.KindInternal)
+	ok := s.checkRoute(w, r, rt, clientIP)
+	span.SetAttribute("sandpiper.allowed", ok)
+	span.End()
+	if !ok {
 		return
 	}
-	if res.EndRoute.AuthMode != "" {
-		switch res.EndRoute.AuthMode {
+	rt.ReverseProxy(w, r)
+}
+
+// checkRoute runs the route checks (access list, rate limit, auth and
+// limits). It returns false if the request was rejected.
+func (s *sServer) checkRoute(w http.ResponseWriter, r *http.Request, rt *route.Route, clientIP net.IP) bool {
+	if !rt.Allowed(clientIP) {
+		s.requestLogger(r).Debug("denied", "client_ip", clientIP.String(), "route", rt.Domain)
+		rt.WriteError(w, r, s.denyStatus(rt), "")
+		return false
+	}
+	if rt.ServeMaintenance(w, r, clientIP) {
+		return false
+	}
+	if res, ok := rt.TakeRateLimit(r, clientIP); ok {
+		ratelimit.WriteHeaders(w.Header(), res)
+		if !res.Allowed {
+			rt.WriteError(w, r, http.StatusTooManyRequests, "")
+			return false
+		}
+	}
+	if rt.AuthMode != "" {
+		switch rt.AuthMode {
 		case "apikey":
-			if res.EndRoute.AuthValue != r.Header.Get(res.EndRoute.AuthKey) {
-				w.WriteHeader(http.StatusUnauthorized)
-				return
+			if rt.AuthValue != r.Header.Get(rt.AuthKey) {
+				rt.WriteError(w, r, http.StatusUnauthorized, "")
+				return false
 			}
 		}
 	}
-	res.EndRoute.ReverseProxy(w, r)
+	return s.applyLimits(w, r, rt)
+}
+
+// applyLimits enforces the header and body limits and sets the route
+// timeouts. It returns false if the request was rejected.
+func (s *sServer) applyLimits(w http.ResponseWriter, r *http.Request, rt *route.Route) bool {
+	if rt.MaxHeaderBytes > 0 && headerSize(r) > rt.MaxHeaderBytes {
+		rt.WriteError(w, r, http.StatusRequestHeaderFieldsTooLarge, "")
+		return false
+	}
+	maxBody := s.Cfg.MaxBodyBytes
+	if rt.MaxBodyBytes > 0 {
+		maxBody = rt.MaxBodyBytes
+	}
+	if maxBody > 0 {
+		if r.ContentLength > maxBody {
+			rt.WriteError(w, r, http.StatusRequestEntityTooLarge, "")
+			return false
+		}
+		if r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+		}
+	}
+	rc := http.NewResponseController(w)
+	if rt.ReadTimeout > 0 {
+		if err := rc.SetReadDeadline(time.Now().Add(time.Duration(rt.ReadTimeout) * time.Second)); err != nil {
+			s.requestLogger(r).Debug("route read timeout", "err", err)
+		}
+	}
+	if rt.WriteTimeout > 0 {
+		if err := rc.SetWriteDeadline(time.Now().Add(time.Duration(rt.WriteTimeout) * time.Second)); err != nil {
+			s.requestLogger(r).Debug("route write timeout", "err", err)
+		}
+	}
+	return true
+}
+
+// unknownHostStatus is 421 (Misdirected Request) when the TLS connection
+// was opened for another server name and 404 otherwise
+func unknownHostStatus(r *http.Request, host string) int {
+	if r.TLS != nil && r.TLS.ServerName != "" {
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if !strings.EqualFold(r.TLS.ServerName, host) {
+			return http.StatusMisdirectedRequest
+		}
+	}
+	return http.StatusNotFound
+}
+
+// headerSize approximates the size of the request line and headers
+func headerSize(r *http.Request) int {
+	n := len(r.Method) + len(r.RequestURI) + len(r.Proto) + 4
+	for k, vv := range r.Header {
+		for _, v := range vv {
+			n += len(k) + len(v) + 4
+		}
+	}
+	return n
+}
+
+func (s *sServer) denyStatus(rt *route.Route) int {
+	if rt != nil && rt.DenyStatus > 0 {
+		return rt.DenyStatus
+	}
+	if s.Cfg.DenyStatus > 0 {
+		return s.Cfg.DenyStatus
+	}
+	return http.StatusForbidden
+}
+
+func (s *sServer) logAccess(w *util.ResponseWriter, r *http.Request, info *util.RequestInfo, start time.Time) {
+	enabled := s.accessLog.Enabled()
+	if rt := s.domains[info.Route]; rt != nil && rt.AccessLog != nil {
+		enabled = *rt.AccessLog
+	}
+	if !enabled || !s.accessLog.Sampled() {
+		return
+	}
+	e := &accesslog.Entry{
+		Time:            start,
+		RequestID:       info.ID,
+		RemoteAddr:      r.RemoteAddr,
+		Host:            r.Host,
+		Method:          r.Method,
+		URI:             r.RequestURI,
+		Proto:           r.Proto,
+		Route:           info.Route,
+		Upstream:        info.Upstream,
+		Status:          w.Status,
+		Bytes:           w.Bytes,
+		Duration:        float64(time.Since(start)) / float64(time.Millisecond),
+		UpstreamLatency: float64(info.UpstreamLatency) / float64(time.Millisecond),
+		Referer:         r.Referer(),
+		UserAgent:       r.UserAgent(),
+	}
+	if e.RequestID == "" {
+		e.RequestID = r.Header.Get("X-Request-ID")
+	}
+	if info.ClientIP != nil {
+		e.ClientIP = info.ClientIP.String()
+	}
+	if info.UpstreamError != nil {
+		e.UpstreamError = info.UpstreamError.Error()
+	}
+	if r.TLS != nil {
+		e.TLSVersion = accesslog.TLSVersionName(r.TLS.Version)
+	}
+	s.accessLog.Log(e)
+}
+
+func (s *sServer) endServerSpan(span *tracing.Span, w *util.ResponseWriter, r *http.Request, info *util.RequestInfo) {
+	span.SetAttribute("http.request.method", r.Method)
+	span.SetAttribute("http.response.status_code", w.Status)
+	span.SetAttribute("server.address", r.Host)
+	span.SetAttribute("url.path", r.URL.Path)
+	span.SetAttribute("sandpiper.route", info.Route)
+	if info.Upstream != "" {
+		span.SetAttribute("sandpiper.upstream", info.Upstream)
+	}
+	span.SetError(info.UpstreamError)
+	span.End()
+}
+
+// setRequestID assigns the request id (or accepts the trusted incoming
+// one), forwards it to the upstream and echoes it in the response
+func (s *sServer) setRequestID(w http.ResponseWriter, r *http.Request, info *util.RequestInfo) {
+	header := s.Cfg.RequestIDHeader
+	if header == "" {
+		header = "X-Request-ID"
+	}
+	id := r.Header.Get(header)
+	if id == "" || !s.Cfg.TrustRequestID || !validRequestID(id) || !s.trustedHop(r) {
+		id = newRequestID()
+	}
+	info.ID = id
+	r.Header.Set(header, id)
+	w.Header().Set(header, id)
+}
+
+// trustedHop reports whether the connection comes from a trusted proxy
+// (none if there are no trusted proxies configured)
+func (s *sServer) trustedHop(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ipacl.Contains(s.trustedProxies, ip)
+}
+
+func validRequestID(id string) bool {
+	if len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newLogger creates the server logger from the config
+func (s *sServer) newLogger() *slog.Logger {
+	h := s.Cfg.LogHandler
+	if h == nil {
+		var cfg logging.Config
+		if s.Cfg.Log != nil {
+			cfg = *s.Cfg.Log
+		}
+		var err error
+		if h, err = logging.NewHandler(cfg, s.Cfg.Debug); err != nil {
+			h, _ = logging.NewHandler(logging.Config{}, s.Cfg.Debug)
+			defer slog.New(h).Error("log config", "err", err)
+		}
+	}
+	return slog.New(h)
+}
+
+// tlsLogger is the logger of the certificate subsystem
+func (s *sServer) tlsLogger() *slog.Logger {
+	return s.rootLogger.With("subsystem", "tls")
+}
+
+// requestLogger returns a logger with the request id
+func (s *sServer) requestLogger(r *http.Request) *slog.Logger {
+	return s.Logger.With("request_id", util.RequestID(r.Context()))
 }
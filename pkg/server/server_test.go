@@ -1,14 +1,36 @@
 package server
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/gabstv/sandpiper/internal/pkg/ipacl"
 	"github.com/gabstv/sandpiper/internal/pkg/route"
+	"github.com/gabstv/sandpiper/pkg/accesslog"
+	"github.com/gabstv/sandpiper/pkg/errorpage"
+	"github.com/gabstv/sandpiper/pkg/ratelimit"
+	"github.com/gabstv/sandpiper/pkg/tlspolicy"
+	"github.com/gabstv/sandpiper/pkg/tracing"
 	"github.com/gabstv/sandpiper/pkg/util"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
 )
 
 func testRequest(host, method, path string) (respRec *httptest.ResponseRecorder, r *http.Request) {
@@ -74,8 +96,8 @@ func TestServerBasic(t *testing.T) {
 	w, r = testRequest("notfound.net", "GET", "/")
 
 	sv.ServeHTTP(w, r)
-	if w.Code != http.StatusInternalServerError {
-		t.Fatalf("(notfound.net) Status should be %v but it is %v", http.StatusInternalServerError, w.Code)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("(notfound.net) Status should be %v but it is %v", http.StatusNotFound, w.Code)
 	}
 }
 
@@ -175,3 +197,916 @@ func TestRedirect(t *testing.T) {
 		t.Fatal("http status code not 301", resp.Status, resp.StatusCode, resp.Header)
 	}
 }
+
+func TestAccessList(t *testing.T) {
+	sv := Default(&Config{
+		Debug:          true,
+		Deny:           []string{"10.9.0.0/16"},
+		TrustedProxies: []string{"127.0.0.1"},
+	})
+	err := sv.Add(route.Route{
+		Domain:     "admin.example.com",
+		Allow:      []string{"10.0.0.0/8"},
+		DenyStatus: http.StatusNotFound,
+		Server: route.RouteServer{
+			OutConnType: route.REDIRECT,
+			OutAddress:  "https://example.com",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		remote string
+		xff    string
+		status int
+	}{
+		{"10.1.2.3:1234", "", http.StatusPermanentRedirect},
+		{"8.8.8.8:1234", "", http.StatusNotFound},
+		{"10.9.0.1:1234", "", http.StatusForbidden},
+		{"127.0.0.1:1234", "10.1.2.3", http.StatusPermanentRedirect},
+		{"8.8.8.8:1234", "10.1.2.3", http.StatusNotFound},
+	}
+	for _, c := range cases {
+		w, r := testRequest("admin.example.com", "GET", "/")
+		r.RemoteAddr = c.remote
+		if c.xff != "" {
+			r.Header.Set("X-Forwarded-For", c.xff)
+		}
+		sv.ServeHTTP(w, r)
+		if w.Code != c.status {
+			t.Fatalf("(%v xff %q) Status should be %v but it is %v", c.remote, c.xff, c.status, w.Code)
+		}
+	}
+}
+
+func TestBodyLimit(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	sv := Default(&Config{
+		MaxBodyBytes: 1024,
+	})
+	err := sv.Add(route.Route{
+		Domain:       "upload.example.com",
+		MaxBodyBytes: 10,
+		Server: route.RouteServer{
+			OutConnType: route.HTTP,
+			OutAddress:  strings.TrimPrefix(upstream.URL, "http://"),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := strings.Repeat("a", 100)
+	cases := []struct {
+		body          io.Reader
+		contentLength int64
+		status        int
+	}{
+		{strings.NewReader("small"), 5, http.StatusOK},
+		{strings.NewReader(body), 100, http.StatusRequestEntityTooLarge},
+		// unknown length (chunked)
+		{io.MultiReader(strings.NewReader(body)), -1, http.StatusRequestEntityTooLarge},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("POST", "/", c.body)
+		r.Host = "upload.example.com"
+		r.ContentLength = c.contentLength
+		w := httptest.NewRecorder()
+		sv.ServeHTTP(w, r)
+		if w.Code != c.status {
+			t.Fatalf("(content length %v) Status should be %v but it is %v", c.contentLength, c.status, w.Code)
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	spans := make(chan string, 16)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []struct {
+						TraceID string `json:"traceId"`
+						Name    string `json:"name"`
+					} `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}{}
+		json.NewDecoder(r.Body).Decode(&p)
+		for _, rs := range p.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, s := range ss.Spans {
+					spans <- s.TraceID + " " + s.Name
+				}
+			}
+		}
+	}))
+	defer collector.Close()
+	upstreamParent := ""
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamParent = r.Header.Get("traceparent")
+	}))
+	defer upstream.Close()
+
+	sv := Default(&Config{
+		Tracing: &tracing.Config{Endpoint: collector.URL},
+	})
+	sv.Add(route.Route{
+		Domain: "traced.example.com",
+		Server: route.RouteServer{
+			OutConnType: route.HTTP,
+			OutAddress:  strings.TrimPrefix(upstream.URL, "http://"),
+		},
+	})
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Host = "traced.example.com"
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	sv.ServeHTTP(httptest.NewRecorder(), r)
+	sv.(*sServer).tracer.Shutdown()
+
+	if !strings.HasPrefix(upstreamParent, "00-4bf92f3577b34da6a3ce929d0e0e4736-") || strings.Contains(upstreamParent, "00f067aa0ba902b7") {
+		t.Fatalf("the upstream should receive a child traceparent, got %q", upstreamParent)
+	}
+	names := make([]string, 0)
+	for len(spans) > 0 {
+		names = append(names, <-spans)
+	}
+	for _, name := range []string{"route lookup", "auth", "upstream", "GET"} {
+		found := false
+		for _, v := range names {
+			if v == "4bf92f3577b34da6a3ce929d0e0e4736 "+name {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("span %q not exported: %v", name, names)
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	upstreamID := ""
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamID = r.Header.Get("X-Request-ID")
+	}))
+	defer upstream.Close()
+
+	sv := Default(&Config{
+		TrustRequestID: true,
+		TrustedProxies: []string{"10.0.0.1"},
+	})
+	sv.Add(route.Route{
+		Domain: "rid.example.com",
+		Server: route.RouteServer{
+			OutConnType: route.HTTP,
+			OutAddress:  strings.TrimPrefix(upstream.URL, "http://"),
+		},
+	})
+	do := func(remote, id string) string {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = "rid.example.com"
+		r.RemoteAddr = remote
+		if id != "" {
+			r.Header.Set("X-Request-ID", id)
+		}
+		w := httptest.NewRecorder()
+		sv.ServeHTTP(w, r)
+		if got := w.Header().Get("X-Request-ID"); got != upstreamID {
+			t.Fatalf("response id %q should match the upstream id %q", got, upstreamID)
+		}
+		return upstreamID
+	}
+	if id := do("10.0.0.1:1234", "abc-123"); id != "abc-123" {
+		t.Fatalf("trusted id should be kept, got %q", id)
+	}
+	if id := do("8.8.8.8:1234", "abc-123"); id == "abc-123" || len(id) != 32 {
+		t.Fatalf("untrusted id should be replaced, got %q", id)
+	}
+	if id := do("10.0.0.1:1234", ""); len(id) != 32 {
+		t.Fatalf("a new id should be generated, got %q", id)
+	}
+
+	// without trusted proxies nobody is trusted
+	sv = Default(&Config{TrustRequestID: true})
+	sv.Add(route.Route{
+		Domain: "rid.example.com",
+		Server: route.RouteServer{
+			OutConnType: route.HTTP,
+			OutAddress:  strings.TrimPrefix(upstream.URL, "http://"),
+		},
+	})
+	if id := do("10.0.0.1:1234", "abc-123"); id == "abc-123" {
+		t.Fatal("the id should be replaced when there are no trusted proxies")
+	}
+}
+
+func TestAccessLogClientIP(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	out := filepath.Join(t.TempDir(), "access.log")
+	sv := Default(&Config{
+		AccessLog:      &accesslog.Config{Enabled: true, Output: out},
+		TrustedProxies: []string{"10.0.0.1"},
+	})
+	sv.Add(route.Route{
+		Domain: "log.example.com",
+		Server: route.RouteServer{
+			OutConnType: route.HTTP,
+			OutAddress:  strings.TrimPrefix(upstream.URL, "http://"),
+		},
+	})
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Host = "log.example.com"
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "203.0.113.7")
+	sv.ServeHTTP(httptest.NewRecorder(), r)
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &accesslog.Entry{}
+	if err := json.Unmarshal(data, e); err != nil {
+		t.Fatal(err)
+	}
+	if e.ClientIP != "203.0.113.7" || e.RemoteAddr != "10.0.0.1:1234" {
+		t.Fatalf("the entry should log the forwarded client and the peer, got %q %q", e.ClientIP, e.RemoteAddr)
+	}
+}
+
+func TestErrorPages(t *testing.T) {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	addr := strings.TrimPrefix(upstream.URL, "http://")
+	upstream.Close()
+
+	sv := Default(&Config{
+		ErrorPages: &errorpage.Config{HideDetails: true},
+	})
+	sv.Add(route.Route{
+		Domain: "down.example.com",
+		Server: route.RouteServer{
+			OutConnType: route.HTTP,
+			OutAddress:  addr,
+		},
+	})
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Host = "down.example.com"
+	r.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	sv.ServeHTTP(w, r)
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("unreachable upstream status should be %v but it is %v", http.StatusBadGateway, w.Code)
+	}
+	v := struct {
+		Error     string `json:"error"`
+		RequestID string `json:"request_id"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+		t.Fatal(err, w.Body.String())
+	}
+	if v.Error != "Bad Gateway" || v.RequestID == "" {
+		t.Fatalf("unexpected error page %v", w.Body.String())
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Host = "other.example.com"
+	r.TLS = &tls.ConnectionState{ServerName: "down.example.com"}
+	w = httptest.NewRecorder()
+	sv.ServeHTTP(w, r)
+	if w.Code != http.StatusMisdirectedRequest {
+		t.Fatalf("misdirected request status should be %v but it is %v", http.StatusMisdirectedRequest, w.Code)
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	sv := Default(nil)
+	sv.Add(route.Route{
+		Domain: "maint.example.com",
+		Server: route.RouteServer{
+			OutConnType: route.HTTP,
+			OutAddress:  strings.TrimPrefix(upstream.URL, "http://"),
+		},
+	})
+	do := func(remote, bypass string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = "maint.example.com"
+		r.RemoteAddr = remote
+		if bypass != "" {
+			r.Header.Set("X-Maintenance-Bypass", bypass)
+		}
+		w := httptest.NewRecorder()
+		sv.ServeHTTP(w, r)
+		return w
+	}
+	err := sv.SetMaintenance("maint.example.com", route.MaintenanceConfig{
+		Enabled:     true,
+		RetryAfter:  60,
+		Allow:       []string{"10.0.0.0/8"},
+		BypassToken: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := do("8.8.8.8:1234", ""); w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "60" {
+		t.Fatalf("maintenance should return 503 with Retry-After, got %v %v", w.Code, w.Header())
+	}
+	if w := do("10.1.2.3:1234", ""); w.Code != http.StatusOK {
+		t.Fatalf("allowed ip should pass, got %v", w.Code)
+	}
+	if w := do("8.8.8.8:1234", "secret"); w.Code != http.StatusOK {
+		t.Fatalf("bypass header should pass, got %v", w.Code)
+	}
+	sv.SetMaintenance("maint.example.com", route.MaintenanceConfig{})
+	sv.SetMaintenance("", route.MaintenanceConfig{Enabled: true})
+	if w := do("10.1.2.3:1234", ""); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("global maintenance should return 503, got %v", w.Code)
+	}
+	if err := sv.SetMaintenance("nope.example.com", route.MaintenanceConfig{}); err == nil {
+		t.Fatal("unknown domain should return an error")
+	}
+}
+
+func TestMaintenanceAPI(t *testing.T) {
+	sv := Default(&Config{APIListen: "127.0.0.1:9129"})
+	sv.Add(route.Route{
+		Domain: "maint.example.com",
+		Server: route.RouteServer{OutConnType: route.HTTP, OutAddress: "127.0.0.1:1"},
+	})
+	sv.SetMaintenance("maint.example.com", route.MaintenanceConfig{Enabled: true, BypassToken: "secret"})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := sv.(*sServer).startAPI(ctx); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	resp, err := http.Get("http://127.0.0.1:9129/v1/maintenance/maint.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), `"success":true`) || !strings.Contains(string(body), `"enabled":true`) {
+		t.Fatalf("invalid response: %s", body)
+	}
+	if strings.Contains(string(body), "secret") {
+		t.Fatalf("the bypass token should be redacted: %s", body)
+	}
+}
+
+func TestMirror(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		w.Write(b)
+	}))
+	defer upstream.Close()
+	shadowed := make(chan string, 1)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		shadowed <- r.Host + " " + string(b)
+	}))
+	defer shadow.Close()
+
+	sv := Default(nil)
+	err := sv.Add(route.Route{
+		Domain: "mirror.example.com",
+		Server: route.RouteServer{
+			OutConnType: route.HTTP,
+			OutAddress:  strings.TrimPrefix(upstream.URL, "http://"),
+		},
+		Mirror: &route.MirrorConfig{
+			URL:     shadow.URL,
+			Percent: 100,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/", strings.NewReader("payload"))
+	r.Host = "mirror.example.com"
+	w := httptest.NewRecorder()
+	sv.ServeHTTP(w, r)
+	if w.Body.String() != "payload" {
+		t.Fatalf("upstream should receive the body, got %q", w.Body.String())
+	}
+	select {
+	case v := <-shadowed:
+		if v != "mirror.example.com payload" {
+			t.Fatalf("unexpected shadow request %q", v)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("the shadow upstream should receive a copy of the request")
+	}
+}
+
+func testCertPEM(t *testing.T, names ...string) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour * 24),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder})
+}
+
+func TestCertificates(t *testing.T) {
+	dir := t.TempDir()
+	sv := Default(&Config{CachePath: dir})
+	if err := sv.Add(route.Route{
+		Domain:   "auto.example.com",
+		Autocert: true,
+		Server:   route.RouteServer{OutConnType: route.HTTP, OutAddress: "localhost:1"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	s := sv.(*sServer)
+	// autocert caches the private key followed by the certificate chain
+	c, k := testCertPEM(t, "auto.example.com")
+	if err := os.WriteFile(filepath.Join(dir, "auto.example.com"), append(k, c...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s.setupCertificates()
+
+	c, k = testCertPEM(t, "*.example.com")
+	if err := sv.PutCertificate("up.example.com", c, k); err != nil {
+		t.Fatal(err)
+	}
+	if err := sv.PutCertificate("other.net", c, k); err == nil {
+		t.Fatal("a certificate that does not cover the domain should be rejected")
+	}
+	if cert := s.certs.Match(&tls.ClientHelloInfo{ServerName: "up.example.com"}); cert == nil {
+		t.Fatal("the uploaded certificate should be served")
+	}
+
+	list, err := sv.Certificates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources := make(map[string]string)
+	for _, v := range list {
+		sources[v.ID] = v.Source
+	}
+	if sources["auto.example.com"] != "autocert" || sources["upload:up.example.com"] != "upload" || len(list) != 2 {
+		t.Fatalf("unexpected certificates %+v", list)
+	}
+	if list[0].KeyType != "ECDSA" || list[0].NotAfter.IsZero() {
+		t.Fatalf("unexpected certificate details %+v", list[0])
+	}
+
+	// the test certificates expire within the default alert window
+	s.certMonitor.Check(time.Now())
+	if alerts := sv.CertificateAlerts(); len(alerts) != 2 || alerts[1].ID != "upload:up.example.com" || alerts[1].Kind != "expiring" {
+		t.Fatalf("unexpected alerts %+v", alerts)
+	}
+
+	if err := sv.RenewCertificate("other.net"); err == nil {
+		t.Fatal("only acme certificates can be renewed")
+	}
+	for _, domain := range []string{"auto.example.com", "up.example.com"} {
+		if err := sv.DeleteCertificate(domain); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sv.DeleteCertificate("auto.example.com"); err == nil {
+		t.Fatal("deleting a missing certificate should fail")
+	}
+	if list, _ := sv.Certificates(); len(list) != 0 {
+		t.Fatalf("unexpected certificates %+v", list)
+	}
+}
+
+func TestDevCA(t *testing.T) {
+	dir := t.TempDir()
+	sv := Default(&Config{CachePath: dir, LetsEncryptURL: "dev"})
+	for _, domain := range []string{"app.test", "*.wild.test"} {
+		sv.Add(route.Route{
+			Domain: domain,
+			Server: route.RouteServer{OutConnType: route.HTTP, OutAddress: "127.0.0.1:1"},
+		})
+	}
+	s := sv.(*sServer)
+	s.setupCertificates()
+	caPEM, err := sv.DevCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		t.Fatal("invalid dev ca")
+	}
+
+	hello := &tls.ClientHelloInfo{ServerName: "app.test"}
+	cert, err := s.htps.TLSConfig.GetCertificate(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inter := x509.NewCertPool()
+	for _, der := range cert.Certificate[1:] {
+		c, _ := x509.ParseCertificate(der)
+		inter.AddCert(c)
+	}
+	if _, err := cert.Leaf.Verify(x509.VerifyOptions{DNSName: "app.test", Roots: roots, Intermediates: inter}); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := s.htps.TLSConfig.GetCertificate(hello); again != cert {
+		t.Fatal("the dev certificate should be issued once")
+	}
+	if err := sv.RenewCertificate("app.test"); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := s.htps.TLSConfig.GetCertificate(hello); again == cert {
+		t.Fatal("renew should issue a new dev certificate")
+	}
+	// wildcard routes get one wildcard certificate
+	wild, err := s.htps.TLSConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: "a.wild.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wild.Leaf.DNSNames) != 1 || wild.Leaf.DNSNames[0] != "*.wild.test" {
+		t.Fatalf("the wildcard route should get a wildcard certificate, got %v", wild.Leaf.DNSNames)
+	}
+	// client chosen server names get nothing
+	if _, err := s.htps.TLSConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: "random.example"}); err == nil {
+		t.Fatal("server names without a route should not get a dev certificate")
+	}
+	if s.certs.Get(certSourceDev+":random.example") != nil {
+		t.Fatal("server names without a route should not be cached")
+	}
+
+	// the CA is persisted in the cache
+	sv2 := Default(&Config{CachePath: dir, LetsEncryptURL: "dev"})
+	sv2.(*sServer).setupCertificates()
+	if ca2, _ := sv2.DevCA(); string(ca2) != string(caPEM) {
+		t.Fatal("the dev ca should be loaded from the cache")
+	}
+	if _, err := Default(nil).DevCA(); err == nil {
+		t.Fatal("the dev ca should only exist in dev mode")
+	}
+}
+
+func TestTLSPolicy(t *testing.T) {
+	sv := Default(&Config{CachePath: t.TempDir(), TLS: &tlspolicy.Config{Preset: "intermediate", ALPN: []string{"http/1.1"}}})
+	s := sv.(*sServer)
+	s.setupCertificates()
+	cfg := s.htps.TLSConfig
+	if cfg.MinVersion != tls.VersionTLS12 || len(cfg.CipherSuites) == 0 {
+		t.Fatalf("the policy should be applied: %x %v", cfg.MinVersion, cfg.CipherSuites)
+	}
+	if len(cfg.NextProtos) != 2 || cfg.NextProtos[1] != "acme-tls/1" {
+		t.Fatalf("unexpected alpn %v", cfg.NextProtos)
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	sv0 := Default(&Config{CachePath: t.TempDir(), DisableHTTP2: true})
+	s0 := sv0.(*sServer)
+	s0.setupCertificates()
+	for _, v := range s0.htps.TLSConfig.NextProtos {
+		if v == "h2" {
+			t.Fatalf("h2 should not be negotiated: %v", s0.htps.TLSConfig.NextProtos)
+		}
+	}
+	if s0.htps.TLSNextProto == nil {
+		t.Fatal("net/http should not configure h2")
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+	dir := t.TempDir()
+	certPEM, keyPEM := testCertPEM(t, "example.com", "h1.example.com")
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, certPEM, 0600)
+	os.WriteFile(keyFile, keyPEM, 0600)
+	sv := Default(&Config{
+		CachePath:     dir,
+		ListenAddr:    ":9120",
+		ListenAddrTLS: ":9121",
+		H2C:           true,
+	})
+	for _, r := range []route.Route{
+		{Domain: "example.com"},
+		{Domain: "h1.example.com", DisableHTTP2: true},
+	} {
+		r.Server = route.RouteServer{OutConnType: route.HTTP, OutAddress: strings.TrimPrefix(upstream.URL, "http://")}
+		r.Certificate = util.Certificate{CertFile: certFile, KeyFile: keyFile}
+		if err := sv.Add(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go sv.Run()
+	time.Sleep(time.Millisecond * 250)
+
+	for host, major := range map[string]int{"example.com": 2, "h1.example.com": 1} {
+		cl := http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true, ServerName: host},
+			ForceAttemptHTTP2: true,
+		}}
+		req, _ := http.NewRequest("GET", "https://localhost:9121/", nil)
+		req.Host = host
+		resp, err := cl.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.ProtoMajor != major || string(body) != "ok" {
+			t.Fatalf("%s: expected HTTP/%d, got %s %q", host, major, resp.Proto, body)
+		}
+	}
+
+	// cleartext HTTP/2 with prior knowledge
+	// (the HTTP listener only serves the acme challenges when TLS is enabled)
+	sv2 := Default(&Config{
+		ListenAddr: ":9122",
+		DisableTLS: true,
+		H2C:        true,
+	})
+	sv2.Add(route.Route{
+		Domain: "example.com",
+		Server: route.RouteServer{OutConnType: route.HTTP, OutAddress: strings.TrimPrefix(upstream.URL, "http://")},
+	})
+	go sv2.Run()
+	time.Sleep(time.Millisecond * 250)
+	cl := http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	req, _ := http.NewRequest("GET", "http://localhost:9122/", nil)
+	req.Host = "example.com"
+	resp, err := cl.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 || string(body) != "ok" {
+		t.Fatalf("h2c: got %s %q", resp.Proto, body)
+	}
+}
+
+func TestHTTP3(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+	dir := t.TempDir()
+	certPEM, keyPEM := testCertPEM(t, "example.com")
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, certPEM, 0600)
+	os.WriteFile(keyFile, keyPEM, 0600)
+	sv := Default(&Config{
+		CachePath:     dir,
+		ListenAddr:    ":9125",
+		ListenAddrTLS: ":9126",
+		HTTP3:         true,
+	})
+	err := sv.Add(route.Route{
+		Domain:      "example.com",
+		Server:      route.RouteServer{OutConnType: route.HTTP, OutAddress: strings.TrimPrefix(upstream.URL, "http://")},
+		Certificate: util.Certificate{CertFile: certFile, KeyFile: keyFile},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sv.Run()
+	time.Sleep(time.Millisecond * 250)
+	tlsc := &tls.Config{InsecureSkipVerify: true, ServerName: "example.com"}
+
+	cl := http.Client{Transport: &http.Transport{TLSClientConfig: tlsc, ForceAttemptHTTP2: true}}
+	req, _ := http.NewRequest("GET", "https://localhost:9126/", nil)
+	req.Host = "example.com"
+	resp, err := cl.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if v := resp.Header.Get("Alt-Svc"); v != `h3=":9126"; ma=2592000` {
+		t.Fatalf("unexpected Alt-Svc %q on %s", v, resp.Proto)
+	}
+
+	rt := &http3.RoundTripper{TLSClientConfig: tlsc}
+	defer rt.Close()
+	req, _ = http.NewRequest("GET", "https://localhost:9126/", nil)
+	req.Host = "example.com"
+	resp, err = (&http.Client{Transport: rt}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.ProtoMajor != 3 || string(body) != "ok" {
+		t.Fatalf("got %s %q", resp.Proto, body)
+	}
+	if resp.Header.Get("Alt-Svc") != "" {
+		t.Fatal("HTTP/3 responses should not advertise HTTP/3")
+	}
+}
+
+func TestAutocertFailureMetric(t *testing.T) {
+	sv := Default(&Config{
+		CachePath:      t.TempDir(),
+		AutocertAll:    true,
+		LetsEncryptURL: "http://127.0.0.1:1/directory",
+	})
+	sv.Add(route.Route{
+		Domain:   "c.invalid",
+		Autocert: true,
+		Server:   route.RouteServer{OutConnType: route.HTTP, OutAddress: "127.0.0.1:1"},
+	})
+	s := sv.(*sServer)
+	s.setupCertificates()
+	for _, name := range []string{"a.invalid", "b.invalid", "c.invalid"} {
+		if _, err := s.htps.TLSConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: name}); err == nil {
+			t.Fatalf("%v should not get a certificate", name)
+		}
+	}
+	rec := httptest.NewRecorder()
+	s.metrics.registry.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	if !strings.Contains(body, `sandpiper_autocert_failures_total{domain="other"} 2`) || strings.Contains(body, "a.invalid") {
+		t.Fatalf("unknown server names should be counted as other:\n%s", body)
+	}
+	// autocert_all server names don't raise alerts
+	alerts := s.CertificateAlerts()
+	if len(alerts) != 1 || alerts[0].ID != "c.invalid" {
+		t.Fatalf("only the autocert route should raise an alert, got %+v", alerts)
+	}
+}
+
+func TestMetricsAccess(t *testing.T) {
+	sv := Default(&Config{APIKey: "k", TrustedProxies: []string{"10.0.0.1"}})
+	s := sv.(*sServer)
+	allow, _ := ipacl.ParseNets([]string{"127.0.0.0/8", "192.0.2.0/24"})
+	h := s.metricsHandler(allow)
+	cases := []struct {
+		name, remote, xff, key string
+		code                   int
+	}{
+		{"loopback", "127.0.0.1:1", "", "", http.StatusOK},
+		{"allowed network", "192.0.2.7:1", "", "", http.StatusOK},
+		{"other network", "8.8.8.8:1", "", "", http.StatusForbidden},
+		{"api key", "8.8.8.8:1", "", "k", http.StatusOK},
+		{"wrong api key", "8.8.8.8:1", "", "x", http.StatusForbidden},
+		{"api domain route", "127.0.0.1:1", "8.8.8.8", "", http.StatusForbidden},
+		{"forged forwarded loopback", "127.0.0.1:1", "127.0.0.1, 8.8.8.8", "", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		r.RemoteAddr = c.remote
+		if c.xff != "" {
+			r.Header.Set("X-Forwarded-For", c.xff)
+		}
+		if c.key != "" {
+			r.Header.Set("X-API-KEY", c.key)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != c.code {
+			t.Fatalf("%v: status should be %v, got %v", c.name, c.code, w.Code)
+		}
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+	healthy := strings.TrimPrefix(upstream.URL, "http://")
+	sv := Default(&Config{APIListen: "127.0.0.1:9127"})
+	err := sv.Add(route.Route{
+		Domain: "lb.example.com",
+		Server: route.RouteServer{
+			OutConnType: route.LOAD_BALANCER,
+			LoadBalancer: &route.LoadBalancerConfig{Targets: []route.LoadBalancerTargetCfg{
+				{Path: healthy},
+				{Path: "127.0.0.1:1"},
+			}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := sv.(*sServer)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := s.startAPI(ctx); err != nil {
+		t.Fatal(err)
+	}
+	scrape := func() string {
+		resp, err := http.Get("http://127.0.0.1:9127/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+	time.Sleep(time.Millisecond * 100)
+	// the targets are known before the first request
+	if body := scrape(); !strings.Contains(body, `sandpiper_loadbalancer_target_health{route="lb.example.com",target="127.0.0.1:1"} 100`) {
+		t.Fatalf("missing target health:\n%s", body)
+	}
+	for i := 0; i < 4; i++ {
+		rec := httptest.NewRecorder()
+		sv.ServeHTTP(rec, httptest.NewRequest("GET", "http://lb.example.com/", nil))
+	}
+	body := scrape()
+	for _, line := range []string{
+		`sandpiper_loadbalancer_target_health{route="lb.example.com",target="127.0.0.1:1"} 60`,
+		`sandpiper_loadbalancer_target_health{route="lb.example.com",target="` + healthy + `"} 100`,
+		`sandpiper_requests_total{route="lb.example.com",code="2xx"} 2`,
+		`sandpiper_upstream_errors_total{route="lb.example.com"} 2`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Fatalf("missing %s:\n%s", line, body)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			started <- struct{}{}
+			<-release
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+	sv := Default(nil)
+	for _, r := range []route.Route{
+		{Domain: "limited.example.com", RateLimit: &ratelimit.Config{Rate: 1, Burst: 2}},
+		{Domain: "concurrent.example.com"},
+	} {
+		r.Server = route.RouteServer{OutConnType: route.HTTP, OutAddress: strings.TrimPrefix(upstream.URL, "http://")}
+		if r.Domain == "concurrent.example.com" {
+			r.Server.MaxConcurrent = 1
+		}
+		if err := sv.Add(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, code := range []int{200, 200, 429} {
+		rec := httptest.NewRecorder()
+		sv.ServeHTTP(rec, httptest.NewRequest("GET", "http://limited.example.com/", nil))
+		if rec.Code != code {
+			t.Fatalf("request %v: status should be %v but it is %v", i, code, rec.Code)
+		}
+		h := rec.Header()
+		if h.Get("RateLimit-Limit") != "2" || h.Get("RateLimit-Remaining") == "" || h.Get("RateLimit-Reset") == "" {
+			t.Fatalf("request %v: missing RateLimit headers %v", i, h)
+		}
+		if code == 429 && h.Get("Retry-After") != "1" {
+			t.Fatalf("Retry-After should be 1 but it is %q", h.Get("Retry-After"))
+		}
+		if code == 200 && h.Get("Retry-After") != "" {
+			t.Fatal("allowed requests should not have Retry-After")
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://concurrent.example.com/slow", nil))
+	}()
+	<-started
+	rec := httptest.NewRecorder()
+	sv.ServeHTTP(rec, httptest.NewRequest("GET", "http://concurrent.example.com/", nil))
+	close(release)
+	<-done
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status should be 503 when max_concurrent is reached but it is %v", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	sv.ServeHTTP(rec, httptest.NewRequest("GET", "http://concurrent.example.com/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status should be 200 once the slot is free but it is %v", rec.Code)
+	}
+}
@@ -1,15 +1,25 @@
 package server
 
 import (
+	"bytes"
+	"crypto/tls"
+	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/gabstv/sandpiper/internal/pkg/route"
 	"github.com/gabstv/sandpiper/pkg/util"
 	"github.com/gorilla/websocket"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
 )
 
 type wsTestServer struct {
@@ -157,3 +167,139 @@ func TestWebsocket(t *testing.T) {
 		t.Fatalf("Should have received 3 messages!")
 	}
 }
+
+// TestWebsocketHTTP2 opens a websocket with the extended CONNECT method of
+// RFC 8441 (enabled in net/http with GODEBUG=http2xconnect=1)
+func TestWebsocketHTTP2(t *testing.T) {
+	if !strings.Contains(os.Getenv("GODEBUG"), "http2xconnect=1") {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestWebsocketHTTP2$")
+		cmd.Env = append(os.Environ(), "GODEBUG="+os.Getenv("GODEBUG")+",http2xconnect=1")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%v\n%s", err, out)
+		}
+		return
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		for {
+			mt, msg, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			ws.WriteMessage(mt, msg)
+		}
+	}))
+	defer upstream.Close()
+	dir := t.TempDir()
+	certPEM, keyPEM := testCertPEM(t, "example.com")
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, certPEM, 0600)
+	os.WriteFile(keyFile, keyPEM, 0600)
+	sv := Default(&Config{
+		CachePath:     dir,
+		ListenAddr:    ":9123",
+		ListenAddrTLS: ":9124",
+	})
+	err := sv.Add(route.Route{
+		Domain: "example.com",
+		Server: route.RouteServer{
+			OutConnType: route.HTTP,
+			OutAddress:  strings.TrimPrefix(upstream.URL, "http://"),
+		},
+		Certificate: util.Certificate{CertFile: certFile, KeyFile: keyFile},
+		WsCFG:       util.WsConfig{Enabled: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sv.Run()
+	time.Sleep(time.Millisecond * 250)
+
+	conn, err := tls.Dial("tcp", "localhost:9124", &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         "example.com",
+		NextProtos:         []string{"h2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	io.WriteString(conn, http2.ClientPreface)
+	fr := http2.NewFramer(conn, conn)
+	fr.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	fr.WriteSettings()
+	xconnect := false
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sf, ok := f.(*http2.SettingsFrame); ok && !sf.IsAck() {
+			// SETTINGS_ENABLE_CONNECT_PROTOCOL
+			if v, ok := sf.Value(0x8); ok && v == 1 {
+				xconnect = true
+			}
+			fr.WriteSettingsAck()
+			break
+		}
+	}
+	if !xconnect {
+		t.Fatal("the server should allow the extended CONNECT method")
+	}
+
+	var hbuf bytes.Buffer
+	enc := hpack.NewEncoder(&hbuf)
+	for _, v := range [][2]string{
+		{":method", "CONNECT"},
+		{":protocol", "websocket"},
+		{":scheme", "https"},
+		{":path", "/"},
+		{":authority", "example.com"},
+		{"sec-websocket-version", "13"},
+	} {
+		enc.WriteField(hpack.HeaderField{Name: v[0], Value: v[1]})
+	}
+	fr.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: hbuf.Bytes(), EndHeaders: true})
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mh, ok := f.(*http2.MetaHeadersFrame); ok {
+			if status := mh.PseudoValue("status"); status != "200" {
+				t.Fatalf("extended CONNECT status %s", status)
+			}
+			break
+		}
+	}
+	if n := util.ActiveWebsockets(); n != 1 {
+		t.Fatalf("expected 1 active websocket, got %d", n)
+	}
+
+	// a masked text frame (client to server)
+	msg := []byte("hello h2")
+	mask := []byte{1, 2, 3, 4}
+	frame := append([]byte{0x81, 0x80 | byte(len(msg))}, mask...)
+	for i, b := range msg {
+		frame = append(frame, b^mask[i%4])
+	}
+	fr.WriteData(1, false, frame)
+	var echo []byte
+	for len(echo) < len(msg)+2 {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if df, ok := f.(*http2.DataFrame); ok && df.StreamID == 1 {
+			echo = append(echo, df.Data()...)
+		}
+	}
+	if echo[0] != 0x81 || int(echo[1]) != len(msg) || string(echo[2:]) != string(msg) {
+		t.Fatalf("unexpected frame %q", echo)
+	}
+}
@@ -0,0 +1,212 @@
+// Package tlspolicy applies the TLS settings (versions, cipher suites,
+// curves, ALPN and session ticket keys) of the TLS listener.
+package tlspolicy
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/gabstv/sandpiper/pkg/util"
+	"github.com/pkg/errors"
+)
+
+// Presets
+const (
+	// PresetModern allows TLS 1.3 only
+	PresetModern = "modern"
+	// PresetIntermediate allows TLS 1.2 (with AEAD ECDHE suites) and 1.3
+	PresetIntermediate = "intermediate"
+)
+
+// Config is the TLS policy. The fields that are set override the preset.
+type Config struct {
+	// Preset is "modern" or "intermediate" (empty = Go defaults)
+	Preset string `json:"preset,omitempty" yaml:"preset"`
+	// MinVersion and MaxVersion: "1.0", "1.1", "1.2" or "1.3"
+	MinVersion string `json:"min_version,omitempty" yaml:"min_version"`
+	MaxVersion string `json:"max_version,omitempty" yaml:"max_version"`
+	// CipherSuites are the TLS 1.0-1.2 suites by name (e.g.
+	// TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256). TLS 1.3 suites are not
+	// configurable.
+	CipherSuites []string `json:"cipher_suites,omitempty" yaml:"cipher_suites"`
+	// Curves in order of preference: X25519, P256, P384, P521
+	Curves []string `json:"curves,omitempty" yaml:"curves"`
+	// ALPN protocols in order of preference (default: h2, http/1.1)
+	ALPN []string `json:"alpn,omitempty" yaml:"alpn"`
+	// SessionTicketRotation (seconds) rotates the session ticket keys;
+	// the two previous keys are still accepted (0 = Go defaults)
+	SessionTicketRotation int `json:"session_ticket_rotation,omitempty" yaml:"session_ticket_rotation"`
+	// DisableSessionTickets disables session resumption with tickets
+	DisableSessionTickets bool `json:"disable_session_tickets,omitempty" yaml:"disable_session_tickets"`
+}
+
+// acmeALPN is the protocol of the autocert tls-alpn-01 challenges
+const acmeALPN = "acme-tls/1"
+
+var curves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+var presets = map[string]Config{
+	PresetModern: {
+		MinVersion: "1.3",
+		Curves:     []string{"X25519", "P256", "P384"},
+	},
+	PresetIntermediate: {
+		MinVersion: "1.2",
+		CipherSuites: []string{
+			"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+			"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+			"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+			"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+			"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+			"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+		},
+		Curves: []string{"X25519", "P256", "P384"},
+	},
+}
+
+// Apply sets the policy on cfg. An ALPN list replaces the protocols of cfg,
+// except the autocert challenge protocol, which is kept.
+func (c *Config) Apply(cfg *tls.Config) error {
+	p := Config{}
+	if c.Preset != "" {
+		var ok bool
+		if p, ok = presets[strings.ToLower(c.Preset)]; !ok {
+			return errors.Errorf("unknown tls preset %q", c.Preset)
+		}
+	}
+	if c.MinVersion != "" {
+		p.MinVersion = c.MinVersion
+	}
+	if c.MaxVersion != "" {
+		p.MaxVersion = c.MaxVersion
+	}
+	if len(c.CipherSuites) > 0 {
+		p.CipherSuites = c.CipherSuites
+	}
+	if len(c.Curves) > 0 {
+		p.Curves = c.Curves
+	}
+	if p.MinVersion != "" {
+		v, err := util.ParseTLSVersion(p.MinVersion)
+		if err != nil {
+			return err
+		}
+		cfg.MinVersion = v
+	}
+	if p.MaxVersion != "" {
+		v, err := util.ParseTLSVersion(p.MaxVersion)
+		if err != nil {
+			return err
+		}
+		cfg.MaxVersion = v
+	}
+	if cfg.MaxVersion != 0 && cfg.MaxVersion < cfg.MinVersion {
+		return errors.New("tls max_version is lower than min_version")
+	}
+	if len(p.CipherSuites) > 0 {
+		suites, err := parseCipherSuites(p.CipherSuites)
+		if err != nil {
+			return err
+		}
+		cfg.CipherSuites = suites
+	}
+	if len(p.Curves) > 0 {
+		cfg.CurvePreferences = make([]tls.CurveID, 0, len(p.Curves))
+		for _, name := range p.Curves {
+			id, ok := curves[strings.ToUpper(name)]
+			if !ok {
+				return errors.Errorf("unknown tls curve %q", name)
+			}
+			cfg.CurvePreferences = append(cfg.CurvePreferences, id)
+		}
+	}
+	if len(c.ALPN) > 0 {
+		protos := make([]string, 0, len(c.ALPN)+1)
+		for _, v := range c.ALPN {
+			if v == "" {
+				return errors.New("empty alpn protocol")
+			}
+			protos = append(protos, v)
+		}
+		if contains(cfg.NextProtos, acmeALPN) && !contains(protos, acmeALPN) {
+			protos = append(protos, acmeALPN)
+		}
+		cfg.NextProtos = protos
+	}
+	cfg.SessionTicketsDisabled = c.DisableSessionTickets
+	return nil
+}
+
+func parseCipherSuites(names []string) ([]uint16, error) {
+	secure := make(map[string]*tls.CipherSuite)
+	for _, s := range tls.CipherSuites() {
+		secure[s.Name] = s
+	}
+	insecure := make(map[string]bool)
+	for _, s := range tls.InsecureCipherSuites() {
+		insecure[s.Name] = true
+	}
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		s, ok := secure[name]
+		if !ok {
+			if insecure[name] {
+				return nil, errors.Errorf("insecure tls cipher suite %q", name)
+			}
+			return nil, errors.Errorf("unknown tls cipher suite %q", name)
+		}
+		if len(s.SupportedVersions) == 1 && s.SupportedVersions[0] == tls.VersionTLS13 {
+			return nil, errors.Errorf("tls 1.3 cipher suite %q is not configurable", name)
+		}
+		ids = append(ids, s.ID)
+	}
+	return ids, nil
+}
+
+func contains(list []string, v string) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// RotateSessionTickets sets a new session ticket key on cfg every interval
+// until ctx is done. The two previous keys keep decrypting tickets.
+func RotateSessionTickets(ctx context.Context, cfg *tls.Config, interval time.Duration, logger *slog.Logger) {
+	keys := make([][32]byte, 0, 3)
+	rotate := func() {
+		var key [32]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			logger.Error("session ticket key", "err", err)
+			return
+		}
+		keys = append([][32]byte{key}, keys...)
+		if len(keys) > 3 {
+			keys = keys[:3]
+		}
+		cfg.SetSessionTicketKeys(keys)
+	}
+	rotate()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			rotate()
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package tlspolicy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestApply(t *testing.T) {
+	cfg := &tls.Config{NextProtos: []string{"h2", "http/1.1", "acme-tls/1"}}
+	c := &Config{
+		Preset:     "intermediate",
+		MaxVersion: "1.2",
+		Curves:     []string{"p256"},
+		ALPN:       []string{"http/1.1"},
+	}
+	if err := c.Apply(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MinVersion != tls.VersionTLS12 || cfg.MaxVersion != tls.VersionTLS12 {
+		t.Fatalf("unexpected versions %x-%x", cfg.MinVersion, cfg.MaxVersion)
+	}
+	if len(cfg.CipherSuites) != 6 || cfg.CipherSuites[0] != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+		t.Fatalf("unexpected cipher suites %v", cfg.CipherSuites)
+	}
+	if len(cfg.CurvePreferences) != 1 || cfg.CurvePreferences[0] != tls.CurveP256 {
+		t.Fatalf("unexpected curves %v", cfg.CurvePreferences)
+	}
+	if len(cfg.NextProtos) != 2 || cfg.NextProtos[0] != "http/1.1" || cfg.NextProtos[1] != "acme-tls/1" {
+		t.Fatalf("the acme protocol should be kept: %v", cfg.NextProtos)
+	}
+
+	for _, bad := range []Config{
+		{Preset: "ancient"},
+		{MinVersion: "1.4"},
+		{MinVersion: "1.3", MaxVersion: "1.2"},
+		{CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+		{CipherSuites: []string{"TLS_AES_128_GCM_SHA256"}},
+		{CipherSuites: []string{"nope"}},
+		{Curves: []string{"P224"}},
+		{ALPN: []string{""}},
+	} {
+		if err := bad.Apply(&tls.Config{}); err == nil {
+			t.Errorf("expected an error for %+v", bad)
+		}
+	}
+}
+
+func TestMinVersion(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvCfg := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	if err := (&Config{Preset: PresetModern}).Apply(srvCfg); err != nil {
+		t.Fatal(err)
+	}
+	handshake := func(maxVersion uint16) (uint16, error) {
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		defer c2.Close()
+		go tls.Server(c1, srvCfg).Handshake()
+		cl := tls.Client(c2, &tls.Config{InsecureSkipVerify: true, MaxVersion: maxVersion})
+		err := cl.Handshake()
+		return cl.ConnectionState().Version, err
+	}
+	if _, err := handshake(tls.VersionTLS12); err == nil {
+		t.Fatal("TLS 1.2 clients should be rejected by the modern preset")
+	}
+	if v, err := handshake(0); err != nil || v != tls.VersionTLS13 {
+		t.Fatalf("expected a TLS 1.3 handshake, got %x %v", v, err)
+	}
+}
@@ -0,0 +1,249 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// exporter sends batches of spans to the OTLP/HTTP endpoint
+type exporter struct {
+	cfg     Config
+	client  *http.Client
+	dropped atomic.Uint64
+
+	mu      sync.Mutex
+	pending []*Span
+	wake    chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func newExporter(cfg Config) *exporter {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 512
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = 5
+	}
+	if cfg.MaxQueueSize <= 0 {
+		cfg.MaxQueueSize = cfg.BatchSize * 4
+	}
+	e := &exporter{
+		cfg:     cfg,
+		client:  &http.Client{Timeout: time.Second * 10},
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go e.loop()
+	return e
+}
+
+func (e *exporter) add(s *Span) {
+	e.mu.Lock()
+	if len(e.pending) >= e.cfg.MaxQueueSize {
+		// the collector is slow or down
+		e.mu.Unlock()
+		e.dropped.Add(1)
+		return
+	}
+	e.pending = append(e.pending, s)
+	full := len(e.pending) >= e.cfg.BatchSize
+	e.mu.Unlock()
+	if full {
+		select {
+		case e.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (e *exporter) loop() {
+	defer close(e.stopped)
+	t := time.NewTicker(time.Duration(e.cfg.FlushInterval) * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-e.done:
+			e.flush()
+			return
+		case <-t.C:
+			e.flush()
+		case <-e.wake:
+			e.flush()
+		}
+	}
+}
+
+func (e *exporter) shutdown() {
+	select {
+	case <-e.done:
+	default:
+		close(e.done)
+	}
+	<-e.stopped
+}
+
+func (e *exporter) flush() {
+	e.mu.Lock()
+	spans := e.pending
+	e.pending = nil
+	e.mu.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+	body, err := json.Marshal(e.payload(spans))
+	if err != nil {
+		e.cfg.Logger.Error("span marshal", "err", err)
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, e.cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		e.cfg.Logger.Error("span export", "err", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		e.cfg.Logger.Error("span export", "err", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		e.cfg.Logger.Error("span export", "status", resp.Status)
+	}
+}
+
+// OTLP JSON payload (opentelemetry/proto/collector/trace/v1)
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpPayload struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func (e *exporter) payload(spans []*Span) *otlpPayload {
+	ss := otlpScopeSpans{
+		Scope: otlpScope{Name: "github.com/gabstv/sandpiper"},
+		Spans: make([]otlpSpan, 0, len(spans)),
+	}
+	for _, s := range spans {
+		ss.Spans = append(ss.Spans, s.otlp())
+	}
+	return &otlpPayload{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpKeyValue{keyValue("service.name", e.cfg.ServiceName)},
+			},
+			ScopeSpans: []otlpScopeSpans{ss},
+		}},
+	}
+}
+
+func (s *Span) otlp() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := otlpSpan{
+		TraceID:           hex.EncodeToString(s.sc.TraceID[:]),
+		SpanID:            hex.EncodeToString(s.sc.SpanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+	}
+	if s.parentID != [8]byte{} {
+		o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	if s.hasError {
+		o.Status = otlpStatus{Code: 2, Message: s.errMsg}
+	}
+	keys := make([]string, 0, len(s.attrs))
+	for k := range s.attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		o.Attributes = append(o.Attributes, keyValue(k, s.attrs[k]))
+	}
+	return o
+}
+
+func keyValue(key string, v interface{}) otlpKeyValue {
+	kv := otlpKeyValue{Key: key}
+	switch x := v.(type) {
+	case string:
+		kv.Value.StringValue = &x
+	case bool:
+		kv.Value.BoolValue = &x
+	case int:
+		iv := strconv.Itoa(x)
+		kv.Value.IntValue = &iv
+	case int64:
+		iv := strconv.FormatInt(x, 10)
+		kv.Value.IntValue = &iv
+	case float64:
+		kv.Value.DoubleValue = &x
+	default:
+		sv := ""
+		if str, ok := v.(interface{ String() string }); ok {
+			sv = str.String()
+		}
+		kv.Value.StringValue = &sv
+	}
+	return kv
+}
@@ -0,0 +1,321 @@
+// Package tracing implements W3C trace context propagation and exports
+// spans to an OpenTelemetry collector (OTLP/HTTP, JSON encoding).
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Samplers
+const (
+	SamplerAlwaysOn                = "always_on"
+	SamplerAlwaysOff               = "always_off"
+	SamplerTraceIDRatio            = "traceidratio"
+	SamplerParentBasedAlwaysOn     = "parentbased_always_on"
+	SamplerParentBasedTraceIDRatio = "parentbased_traceidratio"
+)
+
+// Config configures the tracer.
+type Config struct {
+	// Endpoint is the OTLP/HTTP traces url, e.g. http://localhost:4318/v1/traces
+	Endpoint string `json:"endpoint" yaml:"endpoint"`
+	// Headers are added to the export requests
+	Headers     map[string]string `json:"headers,omitempty" yaml:"headers"`
+	ServiceName string            `json:"service_name,omitempty" yaml:"service_name"`
+	// Sampler: always_on, always_off, traceidratio, parentbased_always_on
+	// (default) or parentbased_traceidratio
+	Sampler     string  `json:"sampler,omitempty" yaml:"sampler"`
+	SampleRatio float64 `json:"sample_ratio,omitempty" yaml:"sample_ratio"`
+	// BatchSize and FlushInterval (seconds) control the export batches
+	BatchSize     int `json:"batch_size,omitempty" yaml:"batch_size"`
+	FlushInterval int `json:"flush_interval,omitempty" yaml:"flush_interval"`
+	// MaxQueueSize limits the spans waiting for export (default: 4 *
+	// BatchSize). Spans past it are dropped.
+	MaxQueueSize int `json:"max_queue_size,omitempty" yaml:"max_queue_size"`
+	// Logger receives the export errors (default: slog.Default())
+	Logger *slog.Logger `json:"-" yaml:"-"`
+}
+
+// Span kinds (OTLP values)
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+// SpanContext identifies a span inside a trace.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// Valid reports whether the trace and span ids are set.
+func (sc SpanContext) Valid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Traceparent formats the W3C traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + flags
+}
+
+// ParseTraceparent parses a W3C traceparent header value.
+func ParseTraceparent(v string) (SpanContext, bool) {
+	sc := SpanContext{}
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	tid, err := hex.DecodeString(parts[1])
+	if err != nil || len(tid) != 16 {
+		return sc, false
+	}
+	sid, err := hex.DecodeString(parts[2])
+	if err != nil || len(sid) != 8 {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return sc, false
+	}
+	copy(sc.TraceID[:], tid)
+	copy(sc.SpanID[:], sid)
+	sc.Sampled = flags[0]&1 == 1
+	return sc, sc.Valid()
+}
+
+// Tracer creates spans and sends the sampled ones to the exporter.
+// A nil *Tracer creates no spans.
+type Tracer struct {
+	cfg      Config
+	exporter *exporter
+}
+
+// New creates a tracer and starts its exporter.
+func New(cfg Config) (*Tracer, error) {
+	if cfg.Endpoint == "" {
+		return nil, fmt.Errorf("tracing endpoint is empty")
+	}
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = "sandpiper"
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	if cfg.Sampler == "" {
+		cfg.Sampler = SamplerParentBasedAlwaysOn
+	}
+	switch cfg.Sampler {
+	case SamplerAlwaysOn, SamplerAlwaysOff, SamplerTraceIDRatio, SamplerParentBasedAlwaysOn, SamplerParentBasedTraceIDRatio:
+	default:
+		return nil, fmt.Errorf("invalid sampler %q", cfg.Sampler)
+	}
+	return &Tracer{
+		cfg:      cfg,
+		exporter: newExporter(cfg),
+	}, nil
+}
+
+// Shutdown flushes the pending spans and stops the exporter.
+func (t *Tracer) Shutdown() {
+	if t == nil {
+		return
+	}
+	t.exporter.shutdown()
+}
+
+// Dropped returns the number of spans dropped because the export queue
+// was full.
+func (t *Tracer) Dropped() uint64 {
+	if t == nil {
+		return 0
+	}
+	return t.exporter.dropped.Load()
+}
+
+// Flush exports the pending spans.
+func (t *Tracer) Flush() {
+	if t == nil {
+		return
+	}
+	t.exporter.flush()
+}
+
+// StartServer starts the server span of an incoming request, continuing
+// the trace of its traceparent header (if any).
+func (t *Tracer) StartServer(r *http.Request, name string) (context.Context, *Span) {
+	if t == nil {
+		return r.Context(), nil
+	}
+	parent, ok := ParseTraceparent(r.Header.Get("traceparent"))
+	return t.start(r.Context(), name, KindServer, parent, ok)
+}
+
+func (t *Tracer) start(ctx context.Context, name string, kind int, parent SpanContext, hasParent bool) (context.Context, *Span) {
+	s := &Span{
+		tracer: t,
+		name:   name,
+		kind:   kind,
+		start:  time.Now(),
+	}
+	if hasParent {
+		s.sc.TraceID = parent.TraceID
+		s.parentID = parent.SpanID
+		s.sc.Sampled = t.sample(parent, true)
+	} else {
+		rand.Read(s.sc.TraceID[:])
+		s.sc.Sampled = t.sample(s.sc, false)
+	}
+	rand.Read(s.sc.SpanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func (t *Tracer) sample(sc SpanContext, hasParent bool) bool {
+	switch t.cfg.Sampler {
+	case SamplerAlwaysOn:
+		return true
+	case SamplerAlwaysOff:
+		return false
+	case SamplerTraceIDRatio:
+		return ratioSample(sc.TraceID, t.cfg.SampleRatio)
+	case SamplerParentBasedTraceIDRatio:
+		if hasParent {
+			return sc.Sampled
+		}
+		return ratioSample(sc.TraceID, t.cfg.SampleRatio)
+	}
+	// parentbased_always_on
+	if hasParent {
+		return sc.Sampled
+	}
+	return true
+}
+
+func ratioSample(tid [16]byte, ratio float64) bool {
+	if ratio >= 1 {
+		return true
+	}
+	if ratio <= 0 {
+		return false
+	}
+	return binary.BigEndian.Uint64(tid[8:]) < uint64(ratio*(1<<63))*2
+}
+
+type spanKey struct{}
+
+// SpanFromContext returns the current span or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// Start starts a child span of the span in ctx. It returns a nil span if
+// ctx has no span (tracing disabled).
+func Start(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	s := &Span{
+		tracer:   parent.tracer,
+		name:     name,
+		kind:     kind,
+		start:    time.Now(),
+		parentID: parent.sc.SpanID,
+	}
+	s.sc.TraceID = parent.sc.TraceID
+	s.sc.Sampled = parent.sc.Sampled
+	rand.Read(s.sc.SpanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// Inject sets the traceparent header of the span in ctx.
+func Inject(ctx context.Context, h http.Header) {
+	if s := SpanFromContext(ctx); s != nil {
+		h.Set("traceparent", s.sc.Traceparent())
+	}
+}
+
+// Span is a timed operation. All methods are safe to call on a nil span.
+type Span struct {
+	tracer   *Tracer
+	name     string
+	kind     int
+	sc       SpanContext
+	parentID [8]byte
+	start    time.Time
+	end      time.Time
+
+	mu        sync.Mutex
+	attrs     map[string]interface{}
+	errMsg    string
+	hasError  bool
+	endCalled bool
+}
+
+// Context returns the span context.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+// SetAttribute sets a string, bool, int or float attribute.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.attrs == nil {
+		s.attrs = make(map[string]interface{})
+	}
+	s.attrs[key] = value
+	s.mu.Unlock()
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.hasError = true
+	s.errMsg = err.Error()
+	s.mu.Unlock()
+}
+
+// End ends the span and queues it for export (if sampled).
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.endCalled {
+		s.mu.Unlock()
+		return
+	}
+	s.endCalled = true
+	s.end = time.Now()
+	s.mu.Unlock()
+	if s.sc.Sampled {
+		s.tracer.exporter.add(s)
+	}
+}
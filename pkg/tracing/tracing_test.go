@@ -0,0 +1,109 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTraceparent(t *testing.T) {
+	v := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := ParseTraceparent(v)
+	if !ok || !sc.Sampled {
+		t.Fatalf("%v should be a valid sampled traceparent", v)
+	}
+	if sc.Traceparent() != v {
+		t.Fatalf("Traceparent should be %v but it is %v", v, sc.Traceparent())
+	}
+	for _, bad := range []string{
+		"",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		if _, ok := ParseTraceparent(bad); ok {
+			t.Fatalf("%q should be invalid", bad)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	payloads := make(chan *otlpPayload, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := &otlpPayload{}
+		if err := json.NewDecoder(r.Body).Decode(p); err != nil {
+			t.Error(err)
+		}
+		payloads <- p
+	}))
+	defer collector.Close()
+
+	tr, err := New(Config{Endpoint: collector.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, root := tr.StartServer(r, "GET")
+	_, child := Start(ctx, "upstream", KindClient)
+	h := http.Header{}
+	Inject(context.WithValue(ctx, spanKey{}, child), h)
+	child.End()
+	root.End()
+	tr.Shutdown()
+
+	p := <-payloads
+	spans := p.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("2 spans should be exported, got %v", len(spans))
+	}
+	for _, s := range spans {
+		if s.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Fatalf("span %v should continue the incoming trace, got %v", s.Name, s.TraceID)
+		}
+	}
+	if spans[0].ParentSpanID != spans[1].SpanID || spans[1].ParentSpanID != "00f067aa0ba902b7" {
+		t.Fatal("invalid span parents")
+	}
+	sc, _ := ParseTraceparent(h.Get("traceparent"))
+	if sc != child.Context() {
+		t.Fatal("the injected traceparent should point to the child span")
+	}
+}
+
+func TestSampler(t *testing.T) {
+	tr, _ := New(Config{Endpoint: "http://localhost", Sampler: SamplerParentBasedTraceIDRatio, SampleRatio: 0})
+	defer tr.Shutdown()
+	r, _ := http.NewRequest("GET", "/", nil)
+	if _, s := tr.StartServer(r, "GET"); s.Context().Sampled {
+		t.Fatal("new traces should not be sampled with ratio 0")
+	}
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if _, s := tr.StartServer(r, "GET"); !s.Context().Sampled {
+		t.Fatal("sampled parents should be respected")
+	}
+}
+
+func TestExportQueueLimit(t *testing.T) {
+	tr, _ := New(Config{Endpoint: "http://localhost", BatchSize: 10, FlushInterval: 60, MaxQueueSize: 3})
+	r, _ := http.NewRequest("GET", "/", nil)
+	for i := 0; i < 5; i++ {
+		_, s := tr.StartServer(r, "GET")
+		s.End()
+	}
+	tr.exporter.mu.Lock()
+	n := len(tr.exporter.pending)
+	tr.exporter.mu.Unlock()
+	if n != 3 {
+		t.Fatalf("3 spans should be queued, got %v", n)
+	}
+	if tr.Dropped() != 2 {
+		t.Fatalf("2 spans should be dropped, got %v", tr.Dropped())
+	}
+	tr.exporter.mu.Lock()
+	tr.exporter.pending = nil
+	tr.exporter.mu.Unlock()
+	tr.Shutdown()
+}
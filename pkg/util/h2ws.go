@@ -0,0 +1,162 @@
+package util
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// websocketGUID is the magic value of the Sec-WebSocket-Accept header
+// (RFC 6455 section 1.3)
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// isExtendedConnect reports whether req is a websocket opened over HTTP/2
+// with the extended CONNECT method (RFC 8441).
+func isExtendedConnect(req *http.Request) bool {
+	return req.ProtoMajor == 2 && req.Method == http.MethodConnect &&
+		strings.EqualFold(req.Header.Get(":protocol"), "websocket")
+}
+
+// dialExtendedConnect opens an HTTP/1.1 websocket to the upstream of
+// outreq. The response is returned as is when the upstream does not
+// switch protocols.
+func (p *ReverseProxy) dialExtendedConnect(outreq *http.Request) (net.Conn, *bufio.Reader, *http.Response, error) {
+	c, err := net.DialTimeout("tcp", outreq.URL.Host, p.DialTimeout)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		c.Close()
+		return nil, nil, nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+	upreq := &http.Request{
+		Method:     http.MethodGet,
+		URL:        outreq.URL,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     outreq.Header.Clone(),
+		Host:       outreq.URL.Host,
+	}
+	upreq.Header.Del(":protocol")
+	upreq.Header.Set("Connection", "Upgrade")
+	upreq.Header.Set("Upgrade", "websocket")
+	upreq.Header.Set("Sec-WebSocket-Key", key)
+	upreq.Header.Set("Sec-WebSocket-Version", "13")
+	if p.DialTimeout > 0 {
+		c.SetDeadline(time.Now().Add(p.DialTimeout))
+	}
+	if err := upreq.Write(c); err != nil {
+		c.Close()
+		return nil, nil, nil, err
+	}
+	br := bufio.NewReader(c)
+	res, err := http.ReadResponse(br, upreq)
+	if err != nil {
+		c.Close()
+		return nil, nil, nil, err
+	}
+	c.SetDeadline(time.Time{})
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		return c, br, res, nil
+	}
+	if res.Header.Get("Sec-WebSocket-Accept") != websocketAccept(key) {
+		c.Close()
+		return nil, nil, nil, errors.New("websocket: bad handshake")
+	}
+	return c, br, res, nil
+}
+
+// bridgeExtendedConnect copies the websocket frames between the HTTP/2
+// stream of the client and the upstream connection. The frames are not
+// parsed, so the extensions are negotiated end to end.
+func (p *ReverseProxy) bridgeExtendedConnect(rw http.ResponseWriter, req *http.Request, c net.Conn, br *bufio.Reader, res *http.Response) {
+	defer c.Close()
+	for _, h := range []string{"Sec-Websocket-Protocol", "Sec-Websocket-Extensions"} {
+		if v := res.Header.Get(h); v != "" {
+			rw.Header().Set(h, v)
+		}
+	}
+	rc := http.NewResponseController(rw)
+	// the stream lives as long as the websocket
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+	rw.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		p.logger(req).Debug("websocket (h2) flush", "err", err)
+		return
+	}
+	atomic.AddInt64(&activeWebsockets, 1)
+	defer atomic.AddInt64(&activeWebsockets, -1)
+
+	idle := p.WsCFG.ReadDeadlineSeconds
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer c.Close()
+		buf := make([]byte, 32*1024)
+		for {
+			if idle > 0 {
+				rc.SetReadDeadline(time.Now().Add(idle))
+			}
+			n, err := req.Body.Read(buf)
+			if n > 0 {
+				if _, werr := c.Write(buf[:n]); werr != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	buf := make([]byte, 32*1024)
+	for {
+		if idle > 0 {
+			c.SetReadDeadline(time.Now().Add(idle))
+		}
+		n, err := br.Read(buf)
+		if n > 0 {
+			if _, werr := rw.Write(buf[:n]); werr != nil {
+				break
+			}
+			if rc.Flush() != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	c.Close()
+	// unblocks the client read
+	req.Body.Close()
+	<-done
+}
+
+// copyUpstreamResponse writes a non-upgrade upstream response (e.g. the
+// upstream refused the websocket) to the client
+func (p *ReverseProxy) copyUpstreamResponse(rw http.ResponseWriter, res *http.Response) {
+	defer res.Body.Close()
+	for _, h := range hopHeaders {
+		res.Header.Del(h)
+	}
+	copyHeader(rw.Header(), res.Header)
+	rw.WriteHeader(res.StatusCode)
+	p.copyResponse(rw, res.Body)
+}
+
+func websocketAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,106 @@
+package util
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// RequestInfo collects what happened to a request while it was routed
+// and proxied. It is stored in the request context.
+type RequestInfo struct {
+	ID              string
+	ClientIP        net.IP
+	Route           string
+	Upstream        string
+	UpstreamLatency time.Duration
+	UpstreamError   error
+}
+
+type requestInfoKey struct{}
+
+// WithRequestInfo attaches a new RequestInfo to the request context.
+func WithRequestInfo(r *http.Request) (*http.Request, *RequestInfo) {
+	if info := GetRequestInfo(r.Context()); info != nil {
+		return r, info
+	}
+	info := &RequestInfo{}
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)), info
+}
+
+// GetRequestInfo returns the RequestInfo of the context or nil.
+func GetRequestInfo(ctx context.Context) *RequestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*RequestInfo)
+	return info
+}
+
+// RequestID returns the request id stored in the context (or "")
+func RequestID(ctx context.Context) string {
+	if info := GetRequestInfo(ctx); info != nil {
+		return info.ID
+	}
+	return ""
+}
+
+// Error is http.Error with the request id appended to the message
+func Error(w http.ResponseWriter, r *http.Request, msg string, code int) {
+	if id := RequestID(r.Context()); id != "" {
+		msg += "\nrequest id: " + id
+	}
+	http.Error(w, msg, code)
+}
+
+// ResponseWriter records the status code and the amount of bytes written.
+// It keeps the http.Flusher and http.Hijacker behavior of the wrapped
+// writer (needed by websockets).
+type ResponseWriter struct {
+	http.ResponseWriter
+	Status int
+	Bytes  int64
+}
+
+// NewResponseWriter wraps w.
+func NewResponseWriter(w http.ResponseWriter) *ResponseWriter {
+	return &ResponseWriter{ResponseWriter: w}
+}
+
+func (w *ResponseWriter) WriteHeader(code int) {
+	if w.Status == 0 {
+		w.Status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *ResponseWriter) Write(b []byte) (int, error) {
+	if w.Status == 0 {
+		w.Status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.Bytes += int64(n)
+	return n, err
+}
+
+func (w *ResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *ResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("http.Hijacker not implemented")
+	}
+	if w.Status == 0 {
+		w.Status = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
+
+// Unwrap is used by http.ResponseController
+func (w *ResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,109 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Shadow copies requests to a secondary upstream in the background. The
+// responses are discarded.
+type Shadow struct {
+	// Director rewrites the copied request to the shadow upstream
+	Director func(*http.Request)
+	// Transport defaults to http.DefaultTransport
+	Transport http.RoundTripper
+	// Timeout of each shadow request (default 10s)
+	Timeout time.Duration
+	// Observe (optional) receives the result of each shadow request.
+	// status is 0 if the request failed.
+	Observe func(status int, latency time.Duration, err error)
+
+	sem chan struct{}
+}
+
+// NewShadow creates a Shadow for target. At most maxInFlight requests are
+// sent at the same time; the others are dropped.
+func NewShadow(target *url.URL, maxInFlight int) *Shadow {
+	if maxInFlight <= 0 {
+		maxInFlight = 100
+	}
+	return &Shadow{
+		Director: NewSingleHostReverseProxy(target, WsConfig{}, 0).Director,
+		sem:      make(chan struct{}, maxInFlight),
+	}
+}
+
+// Send copies req (with body) and sends it in the background.
+// It returns false if the request was dropped.
+func (s *Shadow) Send(req *http.Request, body []byte) bool {
+	select {
+	case s.sem <- struct{}{}:
+	default:
+		return false
+	}
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = time.Second * 10
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	outreq := req.Clone(ctx)
+	outreq.RequestURI = ""
+	outreq.Body = http.NoBody
+	outreq.ContentLength = int64(len(body))
+	if len(body) > 0 {
+		outreq.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	s.Director(outreq)
+	for _, h := range hopHeaders {
+		outreq.Header.Del(h)
+	}
+	outreq.Header.Set("X-Forwarded-Host", req.Host)
+	go func() {
+		defer func() { <-s.sem }()
+		defer cancel()
+		transport := s.Transport
+		if transport == nil {
+			transport = http.DefaultTransport
+		}
+		start := time.Now()
+		res, err := transport.RoundTrip(outreq)
+		status := 0
+		if err == nil {
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+			status = res.StatusCode
+		}
+		if s.Observe != nil {
+			s.Observe(status, time.Since(start), err)
+		}
+	}()
+	return true
+}
+
+// BufferBody reads up to limit bytes of the request body and restores it
+// so the request can still be proxied. ok is false if the body is larger
+// than limit.
+func BufferBody(req *http.Request, limit int64) (body []byte, ok bool) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true
+	}
+	if req.ContentLength > limit {
+		return nil, false
+	}
+	buf, err := io.ReadAll(io.LimitReader(req.Body, limit+1))
+	if err != nil || int64(len(buf)) > limit {
+		req.Body = readCloser{io.MultiReader(bytes.NewReader(buf), req.Body), req.Body}
+		return nil, false
+	}
+	req.Body = readCloser{bytes.NewReader(buf), req.Body}
+	return buf, true
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -2,10 +2,12 @@ package util
 
 import (
 	"crypto/tls"
-	"log"
+	"fmt"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -31,6 +33,21 @@ func (ln tcpKeepAliveListener) Accept() (c net.Conn, err error) {
 	return tc, nil
 }
 
+// ParseTLSVersion parses "1.0", "1.1", "1.2" or "1.3"
+func ParseTLSVersion(v string) (uint16, error) {
+	switch strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(v)), "TLS") {
+	case "1.0", "10":
+		return tls.VersionTLS10, nil
+	case "1.1", "11":
+		return tls.VersionTLS11, nil
+	case "1.2", "12":
+		return tls.VersionTLS12, nil
+	case "1.3", "13":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("invalid tls version %q", v)
+}
+
 type Certificate struct {
 	CertFile string
 	KeyFile  string
@@ -39,6 +56,13 @@ type Certificate struct {
 type ServerWrapper struct {
 	vanilla  *http.Server
 	graceful *manners.GracefulServer
+	// WrapListener (optional) wraps the tcp listener before the TLS layer
+	WrapListener func(net.Listener) net.Listener
+	// Logger (optional) defaults to slog.Default()
+	Logger *slog.Logger
+	// ConfigureTLS (optional) is called with the tls.Config of the
+	// listener before it starts serving
+	ConfigureTLS func(*tls.Config)
 }
 
 func newServerWrapper(vanilla *http.Server, graceful *manners.GracefulServer) *ServerWrapper {
@@ -85,11 +109,15 @@ func (w *ServerWrapper) IsGraceful() bool {
 }
 
 func (w *ServerWrapper) Close() bool {
+	l := w.Logger
+	if l == nil {
+		l = slog.Default()
+	}
 	if w.graceful != nil {
-		log.Println("Shutting down gracefully...")
+		l.Info("shutting down gracefully")
 		return w.graceful.Close()
 	}
-	log.Println("Shutting down...")
+	l.Info("shutting down")
 	w.vanilla.Close()
 	return true
 }
@@ -102,11 +130,10 @@ func ListenAndServeTLSSNI(server *ServerWrapper, certs []Certificate) error {
 	}
 	config := &tls.Config{}
 	if server.GetTLSConfig() != nil {
-		cfcf := server.GetTLSConfig()
-		*config = *cfcf
+		config = server.GetTLSConfig().Clone()
 	}
 	if config.NextProtos == nil {
-		config.NextProtos = []string{"http/1.1"}
+		config.NextProtos = []string{"h2", "http/1.1"}
 	}
 
 	config.Certificates = make([]tls.Certificate, len(certs))
@@ -120,12 +147,19 @@ func ListenAndServeTLSSNI(server *ServerWrapper, certs []Certificate) error {
 	}
 
 	config.BuildNameToCertificate()
+	if server.ConfigureTLS != nil {
+		server.ConfigureTLS(config)
+	}
 
 	conn, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
-	tlsl := tls.NewListener(tcpKeepAliveListener{conn.(*net.TCPListener)}, config)
+	var ln net.Listener = tcpKeepAliveListener{conn.(*net.TCPListener)}
+	if server.WrapListener != nil {
+		ln = server.WrapListener(ln)
+	}
+	tlsl := tls.NewListener(ln, config)
 
 	//TODO: test this after graceful update
 	//TODO: fix malformed http resp when getting TLS
@@ -1,25 +1,28 @@
 package util
 
 import (
+	"context"
+	"errors"
 	"io"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/gabstv/sandpiper/pkg/tracing"
 	"github.com/gorilla/websocket"
 )
 
-// DEBUG will print extra information to stdout
-var DEBUG = false
+var activeWebsockets int64
 
-func dlogln(stuff ...interface{}) {
-	if DEBUG {
-		log.Println(stuff...)
-	}
+// ActiveWebsockets returns the amount of open websocket bridges
+func ActiveWebsockets() int64 {
+	return atomic.LoadInt64(&activeWebsockets)
 }
 
 // ReverseProxy is an HTTP Handler that takes an incoming request and
@@ -48,8 +51,26 @@ type ReverseProxy struct {
 	// standard logger.
 	ErrorLog *log.Logger
 
+	// Logger is the structured logger (takes precedence over ErrorLog).
+	// If nil, slog.Default() is used.
+	Logger *slog.Logger
+
+	// ErrorHandler (optional) writes the response when the upstream
+	// can't be reached. The default writes the status text of
+	// UpstreamStatus(err).
+	ErrorHandler func(http.ResponseWriter, *http.Request, error)
+
 	// Configure Websocket
 	WsCFG WsConfig
+
+	// DialTimeout is the timeout used to connect websockets to the
+	// backend. If zero, there is no timeout.
+	DialTimeout time.Duration
+
+	// Conns (optional) limits the in-flight requests to the backend. The
+	// requests over the limit are passed to Busy (default: a 503).
+	Conns chan struct{}
+	Busy  http.HandlerFunc
 }
 
 // WsConfig websockets configuration
@@ -195,6 +216,19 @@ func NewSingleHostReverseProxy(target *url.URL, wsconfig WsConfig, flushInterval
 }
 
 func (p *ReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if p.Conns != nil {
+		select {
+		case p.Conns <- struct{}{}:
+			defer func() { <-p.Conns }()
+		default:
+			if p.Busy != nil {
+				p.Busy(rw, req)
+			} else {
+				http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			}
+			return
+		}
+	}
 	transport := p.Transport
 	if transport == nil {
 		transport = http.DefaultTransport
@@ -216,13 +250,15 @@ func (p *ReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 			if v0 := strings.ToLower(req.Header.Get("Connection")); strings.Contains(v0, "upgrade") {
 				if req.Method != "GET" {
 					// cut the cord earlier to avoid useless cpu use
-					http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+					Error(rw, req, "method not allowed", http.StatusMethodNotAllowed)
 					return
 				}
 				useWebsockets = true
 			}
 		}
 	}
+	// websockets over HTTP/2 (RFC 8441)
+	extendedConnect := p.WsCFG.Enabled && isExtendedConnect(req)
 
 	// Remove hop-by-hop headers to the backend.  Especially
 	// important is "Connection" because we want a persistent
@@ -258,12 +294,49 @@ func (p *ReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	outreq.Header.Set("X-Forwarded-Proto", req.URL.Scheme+aa)
 	outreq.Header.Set("X-Forwarded-Host", req.Host)
 
+	info := GetRequestInfo(req.Context())
+	if info != nil {
+		info.Upstream = outreq.URL.Host
+	}
+	ctx, span := tracing.Start(req.Context(), "upstream", tracing.KindClient)
+	defer span.End()
+	span.SetAttribute("server.address", outreq.URL.Host)
+	tracing.Inject(ctx, outreq.Header)
+	start := time.Now()
+
+	if extendedConnect {
+		outreq.Header.Set("X-Forwarded-Proto", "ws"+aa)
+		c, br, res, err := p.dialExtendedConnect(outreq)
+		if info != nil {
+			info.UpstreamLatency = time.Since(start)
+			info.UpstreamError = err
+		}
+		span.SetError(err)
+		if err != nil {
+			p.logger(req).Debug("websocket (h2) dial", "upstream", outreq.URL.Host, "err", err)
+			p.handleError(rw, req, err)
+			return
+		}
+		span.SetAttribute("http.response.status_code", res.StatusCode)
+		if res.StatusCode != http.StatusSwitchingProtocols {
+			p.copyUpstreamResponse(rw, res)
+			c.Close()
+			return
+		}
+		p.bridgeExtendedConnect(rw, req, c, br, res)
+		return
+	}
+
 	if useWebsockets {
 		// connect to the proxied server and asks for websockets!
-		c, err := net.Dial("tcp", outreq.URL.Host)
+		c, err := net.DialTimeout("tcp", outreq.URL.Host, p.DialTimeout)
 		if err != nil {
-			dlogln("net dial tcp error", err)
-			http.Error(rw, "Internal Server Error - "+err.Error(), http.StatusInternalServerError)
+			span.SetError(err)
+			if info != nil {
+				info.UpstreamError = err
+			}
+			p.logger(req).Debug("websocket dial", "upstream", outreq.URL.Host, "err", err)
+			p.handleError(rw, req, err)
 			return
 		}
 		url2 := *outreq.URL
@@ -275,9 +348,15 @@ func (p *ReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		outreq.Header.Del("Sec-Websocket-Extensions")
 
 		proxy2endserver, _, err := websocket.NewClient(c, &url2, outreq.Header, p.WsCFG.ReadBufferSize, p.WsCFG.WriteBufferSize)
+		if info != nil {
+			info.UpstreamLatency = time.Since(start)
+			info.UpstreamError = err
+		}
+		span.SetError(err)
 		if err != nil {
-			dlogln("websocket newclient", err, url2.String(), outreq.Header)
-			http.Error(rw, "Internal Server Error - "+err.Error(), http.StatusInternalServerError)
+			p.logger(req).Debug("websocket client", "upstream", url2.String(), "err", err)
+			c.Close()
+			p.handleError(rw, req, err)
 			return
 		}
 
@@ -293,8 +372,10 @@ func (p *ReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		//req.Header.Set("Upgrade", "websocket")
 		client2proxy, err := upgrader.Upgrade(rw, req, nil)
 		if err != nil {
-			dlogln("upgrader error", err)
-			http.Error(rw, "Internal Server Error - "+err.Error(), http.StatusInternalServerError)
+			// the upgrader already replied to the client
+			p.logger(req).Debug("websocket upgrade", "err", err)
+			proxy2endserver.Close()
+			return
 		}
 		//
 		wsb := &wsbridge{
@@ -302,6 +383,8 @@ func (p *ReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 			client2proxy:   client2proxy,
 			rp:             p,
 		}
+		atomic.AddInt64(&activeWebsockets, 1)
+		defer atomic.AddInt64(&activeWebsockets, -1)
 		go wsb.ClientLoopRead()
 		wsb.EndpointLoopRead()
 		//
@@ -309,9 +392,20 @@ func (p *ReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	}
 
 	res, err := transport.RoundTrip(outreq)
+	if info != nil {
+		info.UpstreamLatency = time.Since(start)
+		info.UpstreamError = err
+	}
+	span.SetError(err)
+	if res != nil {
+		span.SetAttribute("http.response.status_code", res.StatusCode)
+	}
 	if err != nil {
-		p.logf("http: proxy error: %v", err)
-		rw.WriteHeader(http.StatusInternalServerError)
+		var maxerr *http.MaxBytesError
+		if !errors.As(err, &maxerr) {
+			p.logError(req, outreq.URL.Host, "proxy error", err)
+		}
+		p.handleError(rw, req, err)
 		return
 	}
 	defer res.Body.Close()
@@ -343,12 +437,45 @@ func (p *ReverseProxy) copyResponse(dst io.Writer, src io.Reader) {
 	io.Copy(dst, src)
 }
 
-func (p *ReverseProxy) logf(format string, args ...interface{}) {
-	if p.ErrorLog != nil {
-		p.ErrorLog.Printf(format, args...)
-	} else {
-		log.Printf(format, args...)
+func (p *ReverseProxy) handleError(rw http.ResponseWriter, req *http.Request, err error) {
+	if p.ErrorHandler != nil {
+		p.ErrorHandler(rw, req, err)
+		return
+	}
+	status := UpstreamStatus(err)
+	Error(rw, req, http.StatusText(status), status)
+}
+
+// UpstreamStatus returns the status code of an upstream error:
+// 413 if the request body was too large, 504 for timeouts and 502 for
+// everything else.
+func UpstreamStatus(err error) int {
+	var maxerr *http.MaxBytesError
+	if errors.As(err, &maxerr) {
+		return http.StatusRequestEntityTooLarge
+	}
+	var nerr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &nerr) && nerr.Timeout()) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// logger returns the proxy logger with the request id
+func (p *ReverseProxy) logger(req *http.Request) *slog.Logger {
+	l := p.Logger
+	if l == nil {
+		l = slog.Default()
+	}
+	return l.With("request_id", RequestID(req.Context()))
+}
+
+func (p *ReverseProxy) logError(req *http.Request, upstream, msg string, err error) {
+	if p.Logger == nil && p.ErrorLog != nil {
+		p.ErrorLog.Printf("http: %s: %v", msg, err)
+		return
 	}
+	p.logger(req).Error(msg, "upstream", upstream, "err", err)
 }
 
 type writeFlusher interface {